@@ -0,0 +1,488 @@
+package main
+
+import (
+	"math"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+)
+
+// Stripping AggregateLabels or moving datapoints to the overflow series can
+// leave several datapoints in one slice with identical attributes. The merge
+// functions below fold those duplicates into a single datapoint per identity
+// so downstream only ever sees one series. Datapoints are grouped by attribute
+// hash and then compared, so a hash collision never merges distinct series.
+//
+// Every datapoint also carries the identity it had before aggregation
+// (origIDs). Cumulative values only contribute their most recent point per
+// original series, so a series reported twice in the same batch is not
+// counted twice. Delta values are always summed.
+
+// mergeGaugeDataPoints keeps the most recent value for each identity
+func mergeGaugeDataPoints(dps pmetric.NumberDataPointSlice) {
+	groups := groupByIdentity(dps.Len(), func(i int) uint64 {
+		return hashAttributeMap(dps.At(i).Attributes())
+	}, func(i, j int) bool {
+		return attributeMapsEqual(dps.At(i).Attributes(), dps.At(j).Attributes())
+	})
+
+	drop := make([]bool, dps.Len())
+	for _, group := range groups {
+		if len(group) < 2 {
+			continue
+		}
+
+		latest := group[0]
+		for _, idx := range group[1:] {
+			if dps.At(idx).Timestamp() >= dps.At(latest).Timestamp() {
+				latest = idx
+			}
+		}
+
+		target := group[0]
+		if latest != target {
+			dps.At(latest).CopyTo(dps.At(target))
+		}
+		markMerged(drop, group)
+	}
+
+	removeFlagged(drop, dps.RemoveIf)
+}
+
+// mergeSumDataPoints sums the values of each identity, respecting temporality
+func mergeSumDataPoints(dps pmetric.NumberDataPointSlice, temporality pmetric.AggregationTemporality, origIDs []uint64) {
+	groups := groupByIdentity(dps.Len(), func(i int) uint64 {
+		return hashAttributeMap(dps.At(i).Attributes())
+	}, func(i, j int) bool {
+		return attributeMapsEqual(dps.At(i).Attributes(), dps.At(j).Attributes())
+	})
+	timestamp := func(i int) pcommon.Timestamp { return dps.At(i).Timestamp() }
+
+	drop := make([]bool, dps.Len())
+	for _, group := range groups {
+		if len(group) < 2 {
+			continue
+		}
+
+		contributors := group
+		if temporality == pmetric.AggregationTemporalityCumulative {
+			contributors = latestPerSeries(group, origIDs, timestamp)
+		}
+
+		var intSum int64
+		var doubleSum float64
+		isDouble := false
+		start, end := mergeWindow(contributors,
+			func(i int) pcommon.Timestamp { return dps.At(i).StartTimestamp() }, timestamp)
+		for _, idx := range contributors {
+			dp := dps.At(idx)
+			switch dp.ValueType() {
+			case pmetric.NumberDataPointValueTypeInt:
+				intSum += dp.IntValue()
+			case pmetric.NumberDataPointValueTypeDouble:
+				doubleSum += dp.DoubleValue()
+				isDouble = true
+			}
+		}
+
+		target := dps.At(group[0])
+		if isDouble {
+			target.SetDoubleValue(doubleSum + float64(intSum))
+		} else {
+			target.SetIntValue(intSum)
+		}
+		target.SetStartTimestamp(start)
+		target.SetTimestamp(end)
+		markMerged(drop, group)
+	}
+
+	removeFlagged(drop, dps.RemoveIf)
+}
+
+// mergeHistogramDataPoints merges counts, sums and buckets of each identity.
+// Only histograms with identical explicit bounds are merged together.
+func mergeHistogramDataPoints(dps pmetric.HistogramDataPointSlice, temporality pmetric.AggregationTemporality, origIDs []uint64) {
+	groups := groupByIdentity(dps.Len(), func(i int) uint64 {
+		return histogramIdentity(dps.At(i))
+	}, func(i, j int) bool {
+		return attributeMapsEqual(dps.At(i).Attributes(), dps.At(j).Attributes()) &&
+			float64SlicesEqual(dps.At(i).ExplicitBounds(), dps.At(j).ExplicitBounds())
+	})
+	timestamp := func(i int) pcommon.Timestamp { return dps.At(i).Timestamp() }
+
+	drop := make([]bool, dps.Len())
+	for _, group := range groups {
+		if len(group) < 2 {
+			continue
+		}
+
+		contributors := group
+		if temporality == pmetric.AggregationTemporalityCumulative {
+			contributors = latestPerSeries(group, origIDs, timestamp)
+		}
+
+		start, end := mergeWindow(contributors,
+			func(i int) pcommon.Timestamp { return dps.At(i).StartTimestamp() }, timestamp)
+		var count uint64
+		var sum float64
+		hasSum, hasMin, hasMax := true, true, true
+		min, max := math.Inf(1), math.Inf(-1)
+		buckets := make([]uint64, dps.At(group[0]).BucketCounts().Len())
+		for _, idx := range contributors {
+			dp := dps.At(idx)
+			count += dp.Count()
+			sum += dp.Sum()
+			hasSum = hasSum && dp.HasSum()
+			hasMin = hasMin && dp.HasMin()
+			hasMax = hasMax && dp.HasMax()
+			min = math.Min(min, dp.Min())
+			max = math.Max(max, dp.Max())
+			for b := 0; b < dp.BucketCounts().Len() && b < len(buckets); b++ {
+				buckets[b] += dp.BucketCounts().At(b)
+			}
+		}
+
+		target := dps.At(group[0])
+		target.SetStartTimestamp(start)
+		target.SetTimestamp(end)
+		target.SetCount(count)
+		target.BucketCounts().FromRaw(buckets)
+		if hasSum {
+			target.SetSum(sum)
+		} else {
+			target.RemoveSum()
+		}
+		if hasMin {
+			target.SetMin(min)
+		} else {
+			target.RemoveMin()
+		}
+		if hasMax {
+			target.SetMax(max)
+		} else {
+			target.RemoveMax()
+		}
+		markMerged(drop, group)
+	}
+
+	removeFlagged(drop, dps.RemoveIf)
+}
+
+// mergeExponentialHistogramDataPoints merges counts, sums and buckets of each
+// identity. Histograms with different scales are merged at the coarsest scale
+// among them, and with different zero thresholds at the widest threshold, with
+// buckets that fall within it moved into the zero count.
+func mergeExponentialHistogramDataPoints(dps pmetric.ExponentialHistogramDataPointSlice, temporality pmetric.AggregationTemporality, origIDs []uint64) {
+	groups := groupByIdentity(dps.Len(), func(i int) uint64 {
+		return hashAttributeMap(dps.At(i).Attributes())
+	}, func(i, j int) bool {
+		return attributeMapsEqual(dps.At(i).Attributes(), dps.At(j).Attributes())
+	})
+	timestamp := func(i int) pcommon.Timestamp { return dps.At(i).Timestamp() }
+
+	drop := make([]bool, dps.Len())
+	for _, group := range groups {
+		if len(group) < 2 {
+			continue
+		}
+
+		contributors := group
+		if temporality == pmetric.AggregationTemporalityCumulative {
+			contributors = latestPerSeries(group, origIDs, timestamp)
+		}
+
+		start, end := mergeWindow(contributors,
+			func(i int) pcommon.Timestamp { return dps.At(i).StartTimestamp() }, timestamp)
+		scale := dps.At(contributors[0]).Scale()
+		for _, idx := range contributors[1:] {
+			if s := dps.At(idx).Scale(); s < scale {
+				scale = s
+			}
+		}
+
+		zeroThreshold := dps.At(contributors[0]).ZeroThreshold()
+		for _, idx := range contributors[1:] {
+			zeroThreshold = math.Max(zeroThreshold, dps.At(idx).ZeroThreshold())
+		}
+
+		var count, zeroCount uint64
+		var sum float64
+		hasSum, hasMin, hasMax := true, true, true
+		min, max := math.Inf(1), math.Inf(-1)
+		positive := make(map[int32]uint64)
+		negative := make(map[int32]uint64)
+		for _, idx := range contributors {
+			dp := dps.At(idx)
+			count += dp.Count()
+			zeroCount += dp.ZeroCount()
+			sum += dp.Sum()
+			hasSum = hasSum && dp.HasSum()
+			hasMin = hasMin && dp.HasMin()
+			hasMax = hasMax && dp.HasMax()
+			min = math.Min(min, dp.Min())
+			max = math.Max(max, dp.Max())
+			addExponentialBuckets(positive, dp.Positive(), dp.Scale()-scale)
+			addExponentialBuckets(negative, dp.Negative(), dp.Scale()-scale)
+		}
+		zeroCount += foldIntoZeroCount(positive, scale, zeroThreshold)
+		zeroCount += foldIntoZeroCount(negative, scale, zeroThreshold)
+
+		target := dps.At(group[0])
+		target.SetStartTimestamp(start)
+		target.SetTimestamp(end)
+		target.SetCount(count)
+		target.SetScale(scale)
+		target.SetZeroCount(zeroCount)
+		target.SetZeroThreshold(zeroThreshold)
+		setExponentialBuckets(target.Positive(), positive)
+		setExponentialBuckets(target.Negative(), negative)
+		if hasSum {
+			target.SetSum(sum)
+		} else {
+			target.RemoveSum()
+		}
+		if hasMin {
+			target.SetMin(min)
+		} else {
+			target.RemoveMin()
+		}
+		if hasMax {
+			target.SetMax(max)
+		} else {
+			target.RemoveMax()
+		}
+		markMerged(drop, group)
+	}
+
+	removeFlagged(drop, dps.RemoveIf)
+}
+
+// addExponentialBuckets accumulates bucket counts after downscaling them by
+// shift, where each step halves the resolution
+func addExponentialBuckets(acc map[int32]uint64, buckets pmetric.ExponentialHistogramDataPointBuckets, shift int32) {
+	counts := buckets.BucketCounts()
+	for i := 0; i < counts.Len(); i++ {
+		if c := counts.At(i); c > 0 {
+			acc[(buckets.Offset()+int32(i))>>shift] += c
+		}
+	}
+}
+
+// foldIntoZeroCount removes the buckets whose upper bound lies within the
+// zero threshold and returns their total count
+func foldIntoZeroCount(acc map[int32]uint64, scale int32, zeroThreshold float64) uint64 {
+	if zeroThreshold <= 0 {
+		return 0
+	}
+
+	var folded uint64
+	for idx, c := range acc {
+		// Bucket idx covers (base^idx, base^(idx+1)] with base 2^(2^-scale)
+		if math.Exp2(float64(idx+1)*math.Exp2(-float64(scale))) <= zeroThreshold {
+			folded += c
+			delete(acc, idx)
+		}
+	}
+	return folded
+}
+
+// setExponentialBuckets writes accumulated bucket counts as a dense range
+func setExponentialBuckets(buckets pmetric.ExponentialHistogramDataPointBuckets, acc map[int32]uint64) {
+	if len(acc) == 0 {
+		buckets.SetOffset(0)
+		buckets.BucketCounts().FromRaw(nil)
+		return
+	}
+
+	first, last := int32(math.MaxInt32), int32(math.MinInt32)
+	for idx := range acc {
+		if idx < first {
+			first = idx
+		}
+		if idx > last {
+			last = idx
+		}
+	}
+
+	counts := make([]uint64, last-first+1)
+	for idx, c := range acc {
+		counts[idx-first] = c
+	}
+	buckets.SetOffset(first)
+	buckets.BucketCounts().FromRaw(counts)
+}
+
+// mergeSummaryDataPoints merges counts and sums of each identity. Quantiles
+// cannot be combined, so they are dropped whenever several series are merged.
+func mergeSummaryDataPoints(dps pmetric.SummaryDataPointSlice, origIDs []uint64) {
+	groups := groupByIdentity(dps.Len(), func(i int) uint64 {
+		return hashAttributeMap(dps.At(i).Attributes())
+	}, func(i, j int) bool {
+		return attributeMapsEqual(dps.At(i).Attributes(), dps.At(j).Attributes())
+	})
+	timestamp := func(i int) pcommon.Timestamp { return dps.At(i).Timestamp() }
+
+	drop := make([]bool, dps.Len())
+	for _, group := range groups {
+		if len(group) < 2 {
+			continue
+		}
+
+		// Summaries are always cumulative
+		contributors := latestPerSeries(group, origIDs, timestamp)
+		start, end := mergeWindow(contributors,
+			func(i int) pcommon.Timestamp { return dps.At(i).StartTimestamp() }, timestamp)
+		var count uint64
+		var sum float64
+		for _, idx := range contributors {
+			count += dps.At(idx).Count()
+			sum += dps.At(idx).Sum()
+		}
+
+		target := dps.At(group[0])
+		if len(contributors) == 1 && contributors[0] != group[0] {
+			dps.At(contributors[0]).CopyTo(target)
+		} else if len(contributors) > 1 {
+			target.QuantileValues().RemoveIf(func(pmetric.SummaryDataPointValueAtQuantile) bool {
+				return true
+			})
+		}
+		target.SetStartTimestamp(start)
+		target.SetTimestamp(end)
+		target.SetCount(count)
+		target.SetSum(sum)
+		markMerged(drop, group)
+	}
+
+	removeFlagged(drop, dps.RemoveIf)
+}
+
+// groupByIdentity buckets datapoint indexes by identity, keeping input order
+// both across and within groups. Datapoints sharing an identity hash only join
+// a group when same reports them equal to its first member.
+func groupByIdentity(n int, identity func(i int) uint64, same func(i, j int) bool) [][]int {
+	index := make(map[uint64][]int, n)
+	groups := make([][]int, 0, n)
+	for i := 0; i < n; i++ {
+		id := identity(i)
+		joined := false
+		for _, g := range index[id] {
+			if same(groups[g][0], i) {
+				groups[g] = append(groups[g], i)
+				joined = true
+				break
+			}
+		}
+		if !joined {
+			index[id] = append(index[id], len(groups))
+			groups = append(groups, []int{i})
+		}
+	}
+	return groups
+}
+
+// float64SlicesEqual reports whether two slices hold the same values
+func float64SlicesEqual(a, b pcommon.Float64Slice) bool {
+	if a.Len() != b.Len() {
+		return false
+	}
+	for i := 0; i < a.Len(); i++ {
+		if a.At(i) != b.At(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// attributeMapsEqual reports whether two attribute maps hold the same keys
+// with values of the same type and content
+func attributeMapsEqual(a, b pcommon.Map) bool {
+	if a.Len() != b.Len() {
+		return false
+	}
+	equal := true
+	a.Range(func(k string, va pcommon.Value) bool {
+		vb, ok := b.Get(k)
+		equal = ok && va.Type() == vb.Type() && va.AsString() == vb.AsString()
+		return equal
+	})
+	return equal
+}
+
+// latestPerSeries reduces a group to the most recent datapoint of every
+// original series it contains
+func latestPerSeries(group []int, origIDs []uint64, timestamp func(i int) pcommon.Timestamp) []int {
+	latest := make(map[uint64]int, len(group))
+	order := make([]uint64, 0, len(group))
+	for _, idx := range group {
+		id := origIDs[idx]
+		prev, ok := latest[id]
+		if !ok {
+			order = append(order, id)
+		}
+		if !ok || timestamp(idx) >= timestamp(prev) {
+			latest[id] = idx
+		}
+	}
+
+	result := make([]int, 0, len(order))
+	for _, id := range order {
+		result = append(result, latest[id])
+	}
+	return result
+}
+
+// mergeWindow returns the earliest start and latest end timestamp of a group
+func mergeWindow(idxs []int, start, end func(i int) pcommon.Timestamp) (pcommon.Timestamp, pcommon.Timestamp) {
+	var minStart, maxEnd pcommon.Timestamp
+	for n, idx := range idxs {
+		if s := start(idx); n == 0 || s < minStart {
+			minStart = s
+		}
+		if e := end(idx); e > maxEnd {
+			maxEnd = e
+		}
+	}
+	return minStart, maxEnd
+}
+
+// markMerged flags every datapoint of a group except the first for removal
+func markMerged(drop []bool, group []int) {
+	for _, idx := range group[1:] {
+		drop[idx] = true
+	}
+}
+
+// removeFlagged removes flagged datapoints through a slice's RemoveIf method
+func removeFlagged[T any](drop []bool, removeIf func(func(T) bool)) {
+	i := 0
+	removeIf(func(T) bool {
+		remove := drop[i]
+		i++
+		return remove
+	})
+}
+
+// removeDropped removes dropped datapoints from a slice and returns the
+// identities of the datapoints that remain
+func removeDropped[T any](drop []bool, origIDs []uint64, removeIf func(func(T) bool)) []uint64 {
+	removeFlagged(drop, removeIf)
+
+	kept := origIDs[:0]
+	for i, id := range origIDs {
+		if !drop[i] {
+			kept = append(kept, id)
+		}
+	}
+	return kept
+}
+
+// histogramIdentity combines a histogram's attributes with its explicit
+// bounds, since only histograms with identical buckets can be merged
+func histogramIdentity(dp pmetric.HistogramDataPoint) uint64 {
+	id := hashAttributeMap(dp.Attributes())
+	for i := 0; i < dp.ExplicitBounds().Len(); i++ {
+		id = (id ^ math.Float64bits(dp.ExplicitBounds().At(i))) * fnvPrime64
+	}
+	return id
+}
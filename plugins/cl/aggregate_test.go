@@ -0,0 +1,320 @@
+package main
+
+import (
+	"testing"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+)
+
+func TestHashAttributeMap(t *testing.T) {
+	tests := []struct {
+		name  string
+		a, b  func(m pcommon.Map)
+		equal bool
+	}{
+		{
+			name:  "same attributes in different order",
+			a:     func(m pcommon.Map) { m.PutStr("a", "1"); m.PutStr("b", "2") },
+			b:     func(m pcommon.Map) { m.PutStr("b", "2"); m.PutStr("a", "1") },
+			equal: true,
+		},
+		{
+			name:  "key and value boundary moved",
+			a:     func(m pcommon.Map) { m.PutStr("a", "bc") },
+			b:     func(m pcommon.Map) { m.PutStr("ab", "c") },
+			equal: false,
+		},
+		{
+			name:  "boundary moved across attributes",
+			a:     func(m pcommon.Map) { m.PutStr("a", "b"); m.PutStr("c", "d") },
+			b:     func(m pcommon.Map) { m.PutStr("a", "bc"); m.PutStr("c", "") },
+			equal: false,
+		},
+		{
+			name:  "string and int with the same text",
+			a:     func(m pcommon.Map) { m.PutStr("code", "200") },
+			b:     func(m pcommon.Map) { m.PutInt("code", 200) },
+			equal: false,
+		},
+		{
+			name:  "empty and missing value",
+			a:     func(m pcommon.Map) { m.PutStr("a", "") },
+			b:     func(m pcommon.Map) {},
+			equal: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := pcommon.NewMap(), pcommon.NewMap()
+			tt.a(a)
+			tt.b(b)
+			if got := hashAttributeMap(a) == hashAttributeMap(b); got != tt.equal {
+				t.Errorf("hashes equal = %v, want %v", got, tt.equal)
+			}
+			if got := attributeMapsEqual(a, b); got != tt.equal {
+				t.Errorf("attributeMapsEqual = %v, want %v", got, tt.equal)
+			}
+		})
+	}
+}
+
+func TestGroupByIdentityCollision(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		want   [][]int
+	}{
+		{
+			name:   "distinct series sharing a hash stay apart",
+			values: []string{"a", "b", "a", "c", "b"},
+			want:   [][]int{{0, 2}, {1, 4}, {3}},
+		},
+		{
+			name:   "identical series merge",
+			values: []string{"a", "a", "a"},
+			want:   [][]int{{0, 1, 2}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Every datapoint hashes to the same identity, as in a collision
+			groups := groupByIdentity(len(tt.values), func(int) uint64 { return 42 },
+				func(i, j int) bool { return tt.values[i] == tt.values[j] })
+			if len(groups) != len(tt.want) {
+				t.Fatalf("got %v, want %v", groups, tt.want)
+			}
+			for g := range groups {
+				if len(groups[g]) != len(tt.want[g]) {
+					t.Fatalf("got %v, want %v", groups, tt.want)
+				}
+				for i := range groups[g] {
+					if groups[g][i] != tt.want[g][i] {
+						t.Fatalf("got %v, want %v", groups, tt.want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestMergeSumDataPoints(t *testing.T) {
+	type point struct {
+		route  string
+		origID uint64
+		ts     pcommon.Timestamp
+		value  int64
+	}
+	tests := []struct {
+		name        string
+		temporality pmetric.AggregationTemporality
+		points      []point
+		want        map[string]int64
+	}{
+		{
+			name:        "delta values are summed",
+			temporality: pmetric.AggregationTemporalityDelta,
+			points: []point{
+				{route: "/a", origID: 1, ts: 1, value: 2},
+				{route: "/a", origID: 1, ts: 2, value: 3},
+				{route: "/a", origID: 2, ts: 1, value: 5},
+				{route: "/b", origID: 3, ts: 1, value: 7},
+			},
+			want: map[string]int64{"/a": 10, "/b": 7},
+		},
+		{
+			name:        "cumulative keeps the latest point per original series",
+			temporality: pmetric.AggregationTemporalityCumulative,
+			points: []point{
+				{route: "/a", origID: 1, ts: 1, value: 2},
+				{route: "/a", origID: 1, ts: 2, value: 3},
+				{route: "/a", origID: 2, ts: 1, value: 5},
+			},
+			want: map[string]int64{"/a": 8},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dps := pmetric.NewNumberDataPointSlice()
+			origIDs := make([]uint64, 0, len(tt.points))
+			for _, p := range tt.points {
+				dp := dps.AppendEmpty()
+				dp.Attributes().PutStr("http.route", p.route)
+				dp.SetTimestamp(p.ts)
+				dp.SetIntValue(p.value)
+				origIDs = append(origIDs, p.origID)
+			}
+
+			mergeSumDataPoints(dps, tt.temporality, origIDs)
+
+			if dps.Len() != len(tt.want) {
+				t.Fatalf("got %d datapoints, want %d", dps.Len(), len(tt.want))
+			}
+			for i := 0; i < dps.Len(); i++ {
+				route, _ := dps.At(i).Attributes().Get("http.route")
+				if got, want := dps.At(i).IntValue(), tt.want[route.Str()]; got != want {
+					t.Errorf("%s = %d, want %d", route.Str(), got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMergeHistogramDataPoints(t *testing.T) {
+	type point struct {
+		bounds  []float64
+		buckets []uint64
+	}
+	tests := []struct {
+		name        string
+		points      []point
+		wantBuckets [][]uint64
+	}{
+		{
+			name: "identical bounds are merged",
+			points: []point{
+				{bounds: []float64{1, 10}, buckets: []uint64{1, 2, 3}},
+				{bounds: []float64{1, 10}, buckets: []uint64{4, 5, 6}},
+			},
+			wantBuckets: [][]uint64{{5, 7, 9}},
+		},
+		{
+			name: "mismatched bounds stay unmerged",
+			points: []point{
+				{bounds: []float64{1, 10}, buckets: []uint64{1, 2, 3}},
+				{bounds: []float64{5, 50}, buckets: []uint64{4, 5, 6}},
+			},
+			wantBuckets: [][]uint64{{1, 2, 3}, {4, 5, 6}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dps := pmetric.NewHistogramDataPointSlice()
+			origIDs := make([]uint64, 0, len(tt.points))
+			for i, p := range tt.points {
+				dp := dps.AppendEmpty()
+				dp.Attributes().PutStr("http.route", "/a")
+				dp.ExplicitBounds().FromRaw(p.bounds)
+				dp.BucketCounts().FromRaw(p.buckets)
+				origIDs = append(origIDs, uint64(i))
+			}
+
+			mergeHistogramDataPoints(dps, pmetric.AggregationTemporalityDelta, origIDs)
+
+			if dps.Len() != len(tt.wantBuckets) {
+				t.Fatalf("got %d datapoints, want %d", dps.Len(), len(tt.wantBuckets))
+			}
+			for i, want := range tt.wantBuckets {
+				got := dps.At(i).BucketCounts().AsRaw()
+				if len(got) != len(want) {
+					t.Fatalf("datapoint %d buckets = %v, want %v", i, got, want)
+				}
+				for b := range want {
+					if got[b] != want[b] {
+						t.Fatalf("datapoint %d buckets = %v, want %v", i, got, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestMergeExponentialHistogramZeroThreshold(t *testing.T) {
+	type point struct {
+		scale         int32
+		zeroThreshold float64
+		zeroCount     uint64
+		offset        int32
+		buckets       []uint64
+	}
+	tests := []struct {
+		name          string
+		points        []point
+		wantThreshold float64
+		wantZeroCount uint64
+		wantOffset    int32
+		wantBuckets   []uint64
+	}{
+		{
+			name: "same threshold",
+			points: []point{
+				{zeroThreshold: 0.5, zeroCount: 1, offset: 0, buckets: []uint64{1, 1}},
+				{zeroThreshold: 0.5, zeroCount: 2, offset: 1, buckets: []uint64{3}},
+			},
+			wantThreshold: 0.5,
+			wantZeroCount: 3,
+			wantOffset:    0,
+			wantBuckets:   []uint64{1, 4},
+		},
+		{
+			name: "buckets within the widest threshold move to the zero count",
+			points: []point{
+				// Buckets (1,2], (2,4] and (4,8]
+				{zeroThreshold: 0, zeroCount: 1, offset: 0, buckets: []uint64{1, 1, 1}},
+				{zeroThreshold: 2, zeroCount: 3, offset: 2, buckets: []uint64{2}},
+			},
+			wantThreshold: 2,
+			wantZeroCount: 5,
+			wantOffset:    1,
+			wantBuckets:   []uint64{1, 3},
+		},
+		{
+			name: "threshold applies after downscaling",
+			points: []point{
+				// At scale 1 these are (1,1.41] and (1.41,2], at scale 0 (1,2]
+				{scale: 1, zeroThreshold: 0, offset: 0, buckets: []uint64{1, 1}},
+				{scale: 0, zeroThreshold: 2, offset: 1, buckets: []uint64{1}},
+			},
+			wantThreshold: 2,
+			wantZeroCount: 2,
+			wantOffset:    1,
+			wantBuckets:   []uint64{1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dps := pmetric.NewExponentialHistogramDataPointSlice()
+			origIDs := make([]uint64, 0, len(tt.points))
+			for i, p := range tt.points {
+				dp := dps.AppendEmpty()
+				dp.Attributes().PutStr("http.route", "/a")
+				dp.SetScale(p.scale)
+				dp.SetZeroThreshold(p.zeroThreshold)
+				dp.SetZeroCount(p.zeroCount)
+				dp.Positive().SetOffset(p.offset)
+				dp.Positive().BucketCounts().FromRaw(p.buckets)
+				origIDs = append(origIDs, uint64(i))
+			}
+
+			mergeExponentialHistogramDataPoints(dps, pmetric.AggregationTemporalityDelta, origIDs)
+
+			if dps.Len() != 1 {
+				t.Fatalf("got %d datapoints, want 1", dps.Len())
+			}
+			dp := dps.At(0)
+			if dp.ZeroThreshold() != tt.wantThreshold {
+				t.Errorf("zero threshold = %v, want %v", dp.ZeroThreshold(), tt.wantThreshold)
+			}
+			if dp.ZeroCount() != tt.wantZeroCount {
+				t.Errorf("zero count = %d, want %d", dp.ZeroCount(), tt.wantZeroCount)
+			}
+			if dp.Positive().Offset() != tt.wantOffset {
+				t.Errorf("offset = %d, want %d", dp.Positive().Offset(), tt.wantOffset)
+			}
+			got := dp.Positive().BucketCounts().AsRaw()
+			if len(got) != len(tt.wantBuckets) {
+				t.Fatalf("buckets = %v, want %v", got, tt.wantBuckets)
+			}
+			for b := range got {
+				if got[b] != tt.wantBuckets[b] {
+					t.Fatalf("buckets = %v, want %v", got, tt.wantBuckets)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/plog"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// AttributeLimitConfig bounds the distinct values per attribute key on log
+// records and spans
+type AttributeLimitConfig struct {
+	// MaxValuesPerKey is how many distinct values a key may carry before new
+	// values are over budget
+	MaxValuesPerKey int `mapstructure:"max_values_per_key"`
+
+	// Action applies to over-budget values: "redact" replaces the value,
+	// "hash_bucket" replaces it with one of HashBuckets stable buckets and
+	// "drop" removes the attribute
+	Action      string `mapstructure:"action"`
+	HashBuckets int    `mapstructure:"hash_buckets"`
+}
+
+const (
+	attributeActionRedact     = "redact"
+	attributeActionHashBucket = "hash_bucket"
+	attributeActionDrop       = "drop"
+
+	defaultMaxValuesPerKey = 1000
+	defaultHashBuckets     = 64
+
+	// redactedValue replaces over-budget values under the redact action
+	redactedValue = "<redacted>"
+
+	// maxAttributeKeys bounds how many attribute keys are tracked
+	maxAttributeKeys = 1024
+)
+
+// metrics
+var (
+	limitedAttributesMetric = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cl_limited_attributes_total",
+			Help: "Total number of log and span attribute values limited by the cardinality limiter",
+		},
+		[]string{"signal", "attribute", "action"},
+	)
+)
+
+// processLogs implements the ProcessLogsFunc type
+func (p *cardinalityLimiterProcessor) processLogs(ctx context.Context, ld plog.Logs) (plog.Logs, error) {
+	rl := ld.ResourceLogs()
+	for i := 0; i < rl.Len(); i++ {
+		sl := rl.At(i).ScopeLogs()
+		for j := 0; j < sl.Len(); j++ {
+			records := sl.At(j).LogRecords()
+			for k := 0; k < records.Len(); k++ {
+				p.limitAttributes("logs", records.At(k).Attributes())
+			}
+		}
+	}
+	return ld, nil
+}
+
+// processTraces implements the ProcessTracesFunc type
+func (p *cardinalityLimiterProcessor) processTraces(ctx context.Context, td ptrace.Traces) (ptrace.Traces, error) {
+	rs := td.ResourceSpans()
+	for i := 0; i < rs.Len(); i++ {
+		ss := rs.At(i).ScopeSpans()
+		for j := 0; j < ss.Len(); j++ {
+			spans := ss.At(j).Spans()
+			for k := 0; k < spans.Len(); k++ {
+				p.limitAttributes("traces", spans.At(k).Attributes())
+			}
+		}
+	}
+	return td, nil
+}
+
+// limitAttributes tracks the values of every attribute and applies the
+// configured action to values beyond a key's budget. Protected labels pass
+// untouched, always-drop labels are removed and values are normalized before
+// they are counted. In observe mode the action is applied to a copy.
+func (p *cardinalityLimiterProcessor) limitAttributes(signal string, attrs pcommon.Map) {
+	observing := p.observing()
+	if observing {
+		scratch := pcommon.NewMap()
+		attrs.CopyTo(scratch)
+		attrs = scratch
+	}
+
+	for _, label := range p.config.AlwaysDropLabels {
+		attrs.Remove(label)
+	}
+	p.normalizer.normalize(attrs)
+
+	now := time.Now().UnixNano()
+	cfg := p.config.Attributes
+
+	p.attributeMutex.Lock()
+	defer p.attributeMutex.Unlock()
+
+	attrs.RemoveIf(func(k string, v pcommon.Value) bool {
+		if _, ok := p.protectedLabels[k]; ok {
+			return false
+		}
+
+		values, ok := p.attributeValues[k]
+		if !ok {
+			if len(p.attributeValues) >= maxAttributeKeys {
+				return false
+			}
+			values = make(map[uint64]int64)
+			p.attributeValues[k] = values
+		}
+
+		h := fnv.New64a()
+		h.Write([]byte(v.AsString()))
+		valueHash := h.Sum64()
+		if _, seen := values[valueHash]; seen || len(values) < cfg.MaxValuesPerKey {
+			values[valueHash] = now
+			return false
+		}
+
+		// Over budget
+		if observing {
+			p.observedAttrs.WithLabelValues(signal, k, cfg.Action).Inc()
+			p.logObservedAttribute(signal, k, cfg.Action)
+		} else {
+			p.limitedAttrs.WithLabelValues(signal, k, cfg.Action).Inc()
+		}
+		switch cfg.Action {
+		case attributeActionDrop:
+			return true
+		case attributeActionHashBucket:
+			v.SetStr("bucket_" + strconv.FormatUint(valueHash%uint64(cfg.HashBuckets), 10))
+		default:
+			v.SetStr(redactedValue)
+		}
+		return false
+	})
+}
+
+// expireAttributeValues forgets attribute values not seen since cutoff
+func (p *cardinalityLimiterProcessor) expireAttributeValues(cutoff int64) {
+	p.attributeMutex.Lock()
+	defer p.attributeMutex.Unlock()
+
+	for key, values := range p.attributeValues {
+		for valueHash, lastSeen := range values {
+			if lastSeen < cutoff {
+				delete(values, valueHash)
+			}
+		}
+		if len(values) == 0 {
+			delete(p.attributeValues, key)
+		}
+	}
+}
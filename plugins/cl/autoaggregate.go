@@ -0,0 +1,127 @@
+package main
+
+import (
+	"go.uber.org/zap"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Auto-aggregation learns, per metric, which labels carry the most distinct
+// values among the series the metric creates. Once a metric holds more than
+// MetricBudget series, the label that drove its growth is selected and
+// aggregated away from then on, on top of the static AggregateLabels.
+// Selections last until the collector restarts.
+
+// AutoAggregateConfig controls automatic selection of exploding labels
+type AutoAggregateConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+
+	// MetricBudget is the number of series a metric may hold before labels
+	// are selected for aggregation
+	MetricBudget int `mapstructure:"metric_budget"`
+
+	// MaxLabels bounds how many labels are selected per metric
+	MaxLabels int `mapstructure:"max_labels"`
+}
+
+const (
+	defaultMetricBudget  = 2000
+	defaultMaxAutoLabels = 2
+
+	// minAutoLabelValues is how many distinct values a label must have
+	// contributed since the last selection to be selected
+	minAutoLabelValues = 16
+
+	// maxGrowthSketches bounds the per-metric label sketches (~1 KiB each)
+	maxGrowthSketches = 4096
+)
+
+// metrics
+var (
+	autoAggregatedLabelsMetric = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cl_auto_aggregated_labels",
+			Help: "Labels automatically selected for aggregation by the cardinality limiter, 1 per selected metric and label",
+		},
+		[]string{"metric", "label"},
+	)
+)
+
+// learnGrowth records the label values of the series a metric created in a
+// batch and, once the metric is over budget, selects the label that
+// contributed the most distinct values. It returns the newly selected label,
+// if any. Callers must hold statsMutex.
+func (p *cardinalityLimiterProcessor) learnGrowth(mc metricContext, growth []labelValue) string {
+	cfg := p.config.AutoAggregate
+	stats := mc.stats
+	if !cfg.Enabled || len(growth) == 0 || len(stats.autoLabels) >= cfg.MaxLabels {
+		return ""
+	}
+
+	if stats.growth == nil {
+		stats.growth = make(map[string]*labelSketch)
+	}
+	for _, v := range growth {
+		if v.label == overflowAttribute {
+			continue
+		}
+		sketch, ok := stats.growth[v.label]
+		if !ok {
+			if p.growthSketches >= maxGrowthSketches {
+				continue
+			}
+			sketch = &labelSketch{}
+			stats.growth[v.label] = sketch
+			p.growthSketches++
+		}
+		sketch.addHash(v.hash)
+	}
+
+	if stats.series.Load() < int64(cfg.MetricBudget) {
+		return ""
+	}
+
+	selected, best := "", float64(minAutoLabelValues)
+	for label, sketch := range stats.growth {
+		// Batches in flight during a selection still carry the label
+		if hasLabel(stats.autoLabels, label) {
+			continue
+		}
+		if estimate := sketch.estimate(); estimate >= best {
+			selected, best = label, estimate
+		}
+	}
+	if selected == "" {
+		return ""
+	}
+
+	// Copy on write, since metric contexts share the slice without the lock
+	autoLabels := make([]string, len(stats.autoLabels), len(stats.autoLabels)+1)
+	copy(autoLabels, stats.autoLabels)
+	stats.autoLabels = append(autoLabels, selected)
+
+	// Start over so the next selection reflects growth after this one
+	p.growthSketches -= len(stats.growth)
+	stats.growth = nil
+	return selected
+}
+
+// reportAutoLabel logs and exports a newly selected label
+func (p *cardinalityLimiterProcessor) reportAutoLabel(mc metricContext, label string) {
+	p.logger.Info("Cardinality limiter selected label for aggregation",
+		zap.String("metric", mc.name),
+		zap.String("label", label),
+		zap.Int("metric_budget", p.config.AutoAggregate.MetricBudget))
+	p.autoLabels.WithLabelValues(mc.name, label).Set(1)
+}
+
+// hasLabel reports whether labels contains label
+func hasLabel(labels []string, label string) bool {
+	for _, l := range labels {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.uber.org/zap"
+)
+
+const (
+	// debugPath serves the top offenders page; add ?format=json for JSON
+	debugPath = "/debug/cardinalitylimiter"
+
+	defaultDebugTopN = 20
+
+	// decisionLogSize is how many recent decisions the debug page keeps
+	decisionLogSize = 100
+
+	// maxDecisionsPerSecond bounds decision sampling during storms
+	maxDecisionsPerSecond = 10
+)
+
+// decisionRecord is one sampled limiter decision
+type decisionRecord struct {
+	Time     time.Time `json:"time"`
+	Metric   string    `json:"metric"`
+	Tenant   string    `json:"tenant,omitempty"`
+	Decision string    `json:"decision"`
+	Reason   string    `json:"reason"`
+	Score    float64   `json:"score"`
+	Labels   string    `json:"labels"`
+}
+
+// Reasons a decision was taken
+const (
+	reasonScore  = "score"
+	reasonBudget = "budget"
+)
+
+// decisionLog is a rate-limited ring buffer of recent decisions
+type decisionLog struct {
+	mutex       sync.Mutex
+	records     []decisionRecord
+	next        int
+	windowStart int64
+	windowCount int
+}
+
+func newDecisionLog() *decisionLog {
+	return &decisionLog{records: make([]decisionRecord, 0, decisionLogSize)}
+}
+
+// allow reports whether a decision made at now may be recorded
+func (l *decisionLog) allow(now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	second := now.Unix()
+	if second != l.windowStart {
+		l.windowStart = second
+		l.windowCount = 0
+	}
+	if l.windowCount >= maxDecisionsPerSecond {
+		return false
+	}
+	l.windowCount++
+	return true
+}
+
+// add records a decision, overwriting the oldest once full
+func (l *decisionLog) add(r decisionRecord) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if len(l.records) < decisionLogSize {
+		l.records = append(l.records, r)
+		return
+	}
+	l.records[l.next] = r
+	l.next = (l.next + 1) % decisionLogSize
+}
+
+// recent returns the recorded decisions, newest first
+func (l *decisionLog) recent() []decisionRecord {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	result := make([]decisionRecord, 0, len(l.records))
+	for i := len(l.records) - 1; i >= 0; i-- {
+		result = append(result, l.records[(l.next+i)%len(l.records)])
+	}
+	return result
+}
+
+// formatAttributes renders attributes as sorted key=value pairs
+func formatAttributes(attrs pcommon.Map) string {
+	pairs := make([]string, 0, attrs.Len())
+	attrs.Range(func(k string, v pcommon.Value) bool {
+		pairs = append(pairs, k+"="+v.AsString())
+		return true
+	})
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// debugReport is the content of the top offenders page
+type debugReport struct {
+	GeneratedAt time.Time        `json:"generated_at"`
+	Mode        string           `json:"mode"`
+	KeysUsed    int              `json:"keys_used"`
+	MaxKeys     int              `json:"max_keys"`
+	TopMetrics  []metricReport   `json:"top_metrics"`
+	TopLabels   []labelReport    `json:"top_labels"`
+	Tenants     []tenantReport   `json:"tenants,omitempty"`
+	Decisions   []decisionRecord `json:"recent_decisions"`
+}
+
+// metricReport describes one metric on the debug page
+type metricReport struct {
+	Name           string  `json:"name"`
+	Series         int     `json:"series"`
+	LastScore      float64 `json:"last_score"`
+	MaxScore       float64 `json:"max_score"`
+	Aggregated     uint64  `json:"aggregated"`
+	Overflowed     uint64  `json:"overflowed"`
+	Dropped        uint64  `json:"dropped"`
+	WouldAggregate uint64  `json:"would_aggregate,omitempty"`
+	WouldOverflow  uint64  `json:"would_overflow,omitempty"`
+	WouldDrop      uint64  `json:"would_drop,omitempty"`
+
+	AutoLabels []string `json:"auto_labels,omitempty"`
+}
+
+// labelReport describes one label on the debug page
+type labelReport struct {
+	Name           string `json:"name"`
+	DistinctValues int64  `json:"distinct_values"`
+}
+
+// tenantReport describes one tenant's budget on the debug page
+type tenantReport struct {
+	Name      string `json:"name"`
+	Budget    int    `json:"budget"`
+	Series    int    `json:"series"`
+	Dropped   uint64 `json:"dropped"`
+	WouldDrop uint64 `json:"would_drop,omitempty"`
+}
+
+// buildDebugReport collects the top n metrics and labels
+func (p *cardinalityLimiterProcessor) buildDebugReport(n int) debugReport {
+	p.statsMutex.RLock()
+	report := debugReport{
+		GeneratedAt: time.Now(),
+		Mode:        p.config.Mode,
+		KeysUsed:    p.tracker.len(),
+		MaxKeys:     p.config.MaxKeys,
+		TopMetrics:  make([]metricReport, 0, len(p.metricStats)),
+		TopLabels:   make([]labelReport, 0, len(p.labelSketches)),
+	}
+	for _, stats := range p.metricStats {
+		report.TopMetrics = append(report.TopMetrics, metricReport{
+			Name:           stats.name,
+			Series:         int(stats.series.Load()),
+			LastScore:      stats.lastScore,
+			MaxScore:       stats.maxScore,
+			Aggregated:     stats.aggregated,
+			Overflowed:     stats.overflowed,
+			Dropped:        stats.dropped,
+			WouldAggregate: stats.wouldAggregate,
+			WouldOverflow:  stats.wouldOverflow,
+			WouldDrop:      stats.wouldDrop,
+			AutoLabels:     stats.autoLabels,
+		})
+	}
+	if p.config.Budgets.ResourceAttribute != "" {
+		for _, stats := range p.tenantStats {
+			report.Tenants = append(report.Tenants, tenantReport{
+				Name:      stats.name,
+				Budget:    stats.budget,
+				Series:    int(stats.series.Load()),
+				Dropped:   stats.dropped,
+				WouldDrop: stats.wouldDrop,
+			})
+		}
+	}
+	for name, sketch := range p.labelSketches {
+		report.TopLabels = append(report.TopLabels, labelReport{
+			Name:           name,
+			DistinctValues: int64(sketch.estimate() + 0.5),
+		})
+	}
+	p.statsMutex.RUnlock()
+
+	sort.Slice(report.TopMetrics, func(i, j int) bool {
+		return report.TopMetrics[i].Series > report.TopMetrics[j].Series
+	})
+	sort.Slice(report.TopLabels, func(i, j int) bool {
+		return report.TopLabels[i].DistinctValues > report.TopLabels[j].DistinctValues
+	})
+	sort.Slice(report.Tenants, func(i, j int) bool {
+		return report.Tenants[i].Series > report.Tenants[j].Series
+	})
+	if len(report.TopMetrics) > n {
+		report.TopMetrics = report.TopMetrics[:n]
+	}
+	if len(report.TopLabels) > n {
+		report.TopLabels = report.TopLabels[:n]
+	}
+	report.Decisions = p.decisions.recent()
+
+	return report
+}
+
+var debugPageTemplate = template.Must(template.New("debug").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Cardinality Limiter</title></head>
+<body>
+<h1>Cardinality Limiter</h1>
+<p>Generated {{.GeneratedAt.Format "2006-01-02T15:04:05Z07:00"}} &middot; {{.Mode}} mode &middot; {{.KeysUsed}} of {{.MaxKeys}} keys used &middot; <a href="?format=json">JSON</a></p>
+<h2>Top metrics by series</h2>
+<table border="1" cellpadding="4">
+<tr><th>Metric</th><th>Series</th><th>Last score</th><th>Max score</th><th>Aggregated</th><th>Overflowed</th><th>Dropped</th><th>Would aggregate</th><th>Would overflow</th><th>Would drop</th><th>Auto-aggregated labels</th></tr>
+{{range .TopMetrics}}<tr><td>{{.Name}}</td><td>{{.Series}}</td><td>{{printf "%.3f" .LastScore}}</td><td>{{printf "%.3f" .MaxScore}}</td><td>{{.Aggregated}}</td><td>{{.Overflowed}}</td><td>{{.Dropped}}</td><td>{{.WouldAggregate}}</td><td>{{.WouldOverflow}}</td><td>{{.WouldDrop}}</td><td>{{range $i, $l := .AutoLabels}}{{if $i}}, {{end}}{{$l}}{{end}}</td></tr>
+{{end}}</table>
+<h2>Top labels by distinct values</h2>
+<table border="1" cellpadding="4">
+<tr><th>Label</th><th>Distinct values (approx.)</th></tr>
+{{range .TopLabels}}<tr><td>{{.Name}}</td><td>{{.DistinctValues}}</td></tr>
+{{end}}</table>
+{{if .Tenants}}<h2>Tenants</h2>
+<table border="1" cellpadding="4">
+<tr><th>Tenant</th><th>Series</th><th>Budget</th><th>Dropped</th><th>Would drop</th></tr>
+{{range .Tenants}}<tr><td>{{.Name}}</td><td>{{.Series}}</td><td>{{.Budget}}</td><td>{{.Dropped}}</td><td>{{.WouldDrop}}</td></tr>
+{{end}}</table>
+{{end}}<h2>Recent decisions</h2>
+<table border="1" cellpadding="4">
+<tr><th>Time</th><th>Metric</th><th>Tenant</th><th>Decision</th><th>Reason</th><th>Score</th><th>Labels</th></tr>
+{{range .Decisions}}<tr><td>{{.Time.Format "15:04:05.000"}}</td><td>{{.Metric}}</td><td>{{.Tenant}}</td><td>{{.Decision}}</td><td>{{.Reason}}</td><td>{{printf "%.3f" .Score}}</td><td>{{.Labels}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// handleDebug serves the top offenders page as HTML or JSON
+func (p *cardinalityLimiterProcessor) handleDebug(w http.ResponseWriter, r *http.Request) {
+	n := defaultDebugTopN
+	if limit, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && limit > 0 {
+		n = limit
+	}
+	report := p.buildDebugReport(n)
+
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			p.logger.Debug("Failed to write debug report", zap.Error(err))
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := debugPageTemplate.Execute(w, report); err != nil {
+		p.logger.Debug("Failed to render debug page", zap.Error(err))
+	}
+}
+
+// startDebugServer serves the debug page on DebugEndpoint
+func (p *cardinalityLimiterProcessor) startDebugServer() error {
+	listener, err := net.Listen("tcp", p.config.DebugEndpoint)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(debugPath, p.handleDebug)
+	p.debugServer = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		if err := p.debugServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			p.logger.Error("Cardinality limiter debug server failed", zap.Error(err))
+		}
+	}()
+
+	p.logger.Info("Cardinality limiter debug page available",
+		zap.String("url", "http://"+listener.Addr().String()+debugPath))
+	return nil
+}
+
+// stopDebugServer shuts the debug server down if it is running
+func (p *cardinalityLimiterProcessor) stopDebugServer(ctx context.Context) error {
+	if p.debugServer == nil {
+		return nil
+	}
+	err := p.debugServer.Shutdown(ctx)
+	p.debugServer = nil
+	return err
+}
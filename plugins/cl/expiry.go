@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	defaultSeriesTTL = 10 * time.Minute
+
+	// maxExpiryInterval caps how long an expired key can linger
+	maxExpiryInterval = time.Minute
+
+	// minExpiryInterval keeps a tiny SeriesTTL from scanning the tracker
+	// continuously, and from a zero interval that time.NewTicker rejects
+	minExpiryInterval = time.Second
+)
+
+// expiryLoop periodically removes keys and attribute values not seen within
+// SeriesTTL, so budgets only count what is still reporting
+func (p *cardinalityLimiterProcessor) expiryLoop(ctx context.Context) {
+	defer p.backgroundWg.Done()
+
+	ticker := time.NewTicker(expiryInterval(p.config.SeriesTTL))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.expireKeys()
+		}
+	}
+}
+
+// expiryInterval returns how often keys are expired: half of ttl, clamped to
+// [minExpiryInterval, maxExpiryInterval]
+func expiryInterval(ttl time.Duration) time.Duration {
+	interval := ttl / 2
+	if interval > maxExpiryInterval {
+		return maxExpiryInterval
+	}
+	if interval < minExpiryInterval {
+		return minExpiryInterval
+	}
+	return interval
+}
+
+// expireKeys removes every key whose last sighting is older than SeriesTTL
+// and returns how many were removed. Stale attribute values go with them.
+func (p *cardinalityLimiterProcessor) expireKeys() int {
+	cutoff := time.Now().Add(-p.config.SeriesTTL).UnixNano()
+
+	removed := p.tracker.removeIf(func(entry seriesEntry) bool {
+		return entry.lastSeen < cutoff
+	})
+	p.releaseSeries(removed)
+	expired := len(removed)
+
+	p.keysUsed.Set(float64(p.tracker.len()))
+	p.statsMutex.RLock()
+	p.updateTenantGauges()
+	p.statsMutex.RUnlock()
+
+	p.expiredKeys.Add(float64(expired))
+	p.expireAttributeValues(cutoff)
+	return expired
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpiryInterval(t *testing.T) {
+	tests := []struct {
+		name string
+		ttl  time.Duration
+		want time.Duration
+	}{
+		{name: "half the ttl", ttl: 10 * time.Second, want: 5 * time.Second},
+		{name: "capped", ttl: time.Hour, want: maxExpiryInterval},
+		{name: "clamped", ttl: time.Second, want: minExpiryInterval},
+		{name: "ttl that halves to zero", ttl: time.Nanosecond, want: minExpiryInterval},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := expiryInterval(tt.ttl); got != tt.want {
+				t.Errorf("expiryInterval(%v) = %v, want %v", tt.ttl, got, tt.want)
+			}
+		})
+	}
+}
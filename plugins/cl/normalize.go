@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strconv"
+	"unicode/utf8"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+)
+
+// NormalizeRule rewrites the values of high-cardinality labels so that the
+// label survives with fewer distinct values
+type NormalizeRule struct {
+	// Labels the rule applies to. An empty list applies the rule to every
+	// label except the protected ones.
+	Labels []string `mapstructure:"labels"`
+
+	// Action is "replace", "hash_bucket" or "truncate"
+	Action string `mapstructure:"action"`
+
+	// Pattern and Replacement are used by "replace", with regexp.ReplaceAllString
+	// semantics, e.g. pattern "[0-9]+" and replacement "{id}"
+	Pattern     string `mapstructure:"pattern"`
+	Replacement string `mapstructure:"replacement"`
+
+	// Buckets is the number of stable buckets used by "hash_bucket"
+	Buckets int `mapstructure:"buckets"`
+
+	// MaxLength is the length in characters kept by "truncate"
+	MaxLength int `mapstructure:"max_length"`
+}
+
+const (
+	normalizeActionReplace    = "replace"
+	normalizeActionHashBucket = "hash_bucket"
+	normalizeActionTruncate   = "truncate"
+)
+
+// normalizeRule is a compiled NormalizeRule
+type normalizeRule struct {
+	labels  map[string]struct{}
+	action  string
+	pattern *regexp.Regexp
+	replace string
+	buckets uint64
+	maxLen  int
+}
+
+// normalizer applies the configured rules in order
+type normalizer struct {
+	rules     []normalizeRule
+	protected map[string]struct{}
+}
+
+// newNormalizer compiles the given rules
+func newNormalizer(rules []NormalizeRule, protected map[string]struct{}) (*normalizer, error) {
+	n := &normalizer{protected: protected}
+	for i, rule := range rules {
+		compiled := normalizeRule{action: rule.Action}
+		if len(rule.Labels) > 0 {
+			compiled.labels = make(map[string]struct{}, len(rule.Labels))
+			for _, label := range rule.Labels {
+				compiled.labels[label] = struct{}{}
+			}
+		}
+
+		switch rule.Action {
+		case normalizeActionReplace:
+			re, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid normalize[%d] pattern %q: %v", i, rule.Pattern, err)
+			}
+			compiled.pattern = re
+			compiled.replace = rule.Replacement
+		case normalizeActionHashBucket:
+			if rule.Buckets <= 0 {
+				return nil, fmt.Errorf("normalize[%d]: buckets must be positive, got %d", i, rule.Buckets)
+			}
+			compiled.buckets = uint64(rule.Buckets)
+		case normalizeActionTruncate:
+			if rule.MaxLength <= 0 {
+				return nil, fmt.Errorf("normalize[%d]: max_length must be positive, got %d", i, rule.MaxLength)
+			}
+			compiled.maxLen = rule.MaxLength
+		default:
+			return nil, fmt.Errorf("normalize[%d]: action must be %q, %q or %q, got %q", i,
+				normalizeActionReplace, normalizeActionHashBucket, normalizeActionTruncate, rule.Action)
+		}
+		n.rules = append(n.rules, compiled)
+	}
+	return n, nil
+}
+
+// applies reports whether the rule covers a label
+func (r *normalizeRule) applies(n *normalizer, label string) bool {
+	if r.labels == nil {
+		_, protected := n.protected[label]
+		return !protected
+	}
+	_, ok := r.labels[label]
+	return ok
+}
+
+// apply rewrites a single value
+func (r *normalizeRule) apply(value string) string {
+	switch r.action {
+	case normalizeActionReplace:
+		return r.pattern.ReplaceAllString(value, r.replace)
+	case normalizeActionHashBucket:
+		h := fnv.New64a()
+		h.Write([]byte(value))
+		return "bucket_" + strconv.FormatUint(h.Sum64()%r.buckets, 10)
+	default:
+		if utf8.RuneCountInString(value) <= r.maxLen {
+			return value
+		}
+		i, runes := 0, 0
+		for i = range value {
+			if runes == r.maxLen {
+				break
+			}
+			runes++
+		}
+		return value[:i]
+	}
+}
+
+// normalize rewrites string attribute values in place and reports whether
+// any value changed
+func (n *normalizer) normalize(attrs pcommon.Map) bool {
+	if len(n.rules) == 0 {
+		return false
+	}
+
+	changed := false
+	attrs.Range(func(k string, v pcommon.Value) bool {
+		if v.Type() != pcommon.ValueTypeStr {
+			return true
+		}
+		value := v.Str()
+		for i := range n.rules {
+			if n.rules[i].applies(n, k) {
+				value = n.rules[i].apply(value)
+			}
+		}
+		if value != v.Str() {
+			v.SetStr(value)
+			changed = true
+		}
+		return true
+	})
+	return changed
+}
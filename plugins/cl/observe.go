@@ -0,0 +1,80 @@
+package main
+
+import (
+	"time"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.uber.org/zap"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// In observe mode the limiter scores, tracks and decides exactly as in
+// enforce mode, but on copies of the attributes, so data is forwarded
+// unmodified. What it would have done is counted and sampled to the log.
+
+const (
+	modeEnforce = "enforce"
+	modeObserve = "observe"
+)
+
+// metrics
+var (
+	observedSamplesMetric = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cl_observed_samples_total",
+			Help: "Total number of samples seen in observe mode, by the action the cardinality limiter would have taken",
+		},
+		[]string{"metric", "action"},
+	)
+
+	observedAttributesMetric = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cl_observed_attributes_total",
+			Help: "Total number of log and span attribute values the cardinality limiter would have limited in observe mode",
+		},
+		[]string{"signal", "attribute", "action"},
+	)
+)
+
+// observing reports whether the limiter runs in observe mode
+func (p *cardinalityLimiterProcessor) observing() bool {
+	return p.config.Mode == modeObserve
+}
+
+// limitDataPoint decides on a datapoint. In observe mode the decision is made
+// on a copy of the attributes and the datapoint is always kept.
+func (p *cardinalityLimiterProcessor) limitDataPoint(mc metricContext, attrs pcommon.Map) (uint64, limitDecision) {
+	if !p.observing() {
+		return p.decideDataPoint(mc, attrs)
+	}
+
+	scratch := pcommon.NewMap()
+	attrs.CopyTo(scratch)
+	origID, decision := p.decideDataPoint(mc, scratch)
+	mc.batch.observed[decision]++
+	return origID, decisionKeep
+}
+
+// logObservedDecision logs a sampled would-be decision on a datapoint
+func (p *cardinalityLimiterProcessor) logObservedDecision(record decisionRecord) {
+	p.logger.Info("Cardinality limiter would limit datapoint",
+		zap.String("metric", record.Metric),
+		zap.String("tenant", record.Tenant),
+		zap.String("action", record.Decision),
+		zap.String("reason", record.Reason),
+		zap.Float64("score", record.Score),
+		zap.String("labels", record.Labels))
+}
+
+// logObservedAttribute logs a sampled would-be limit of an attribute value
+func (p *cardinalityLimiterProcessor) logObservedAttribute(signal, key, action string) {
+	if !p.decisions.allow(time.Now()) {
+		return
+	}
+	p.logger.Info("Cardinality limiter would limit attribute",
+		zap.String("signal", signal),
+		zap.String("attribute", key),
+		zap.String("action", action))
+}
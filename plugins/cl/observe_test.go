@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestFlushMetricBatchObserve(t *testing.T) {
+	type counts struct {
+		aggregated, overflowed, dropped uint64
+	}
+	tests := []struct {
+		name      string
+		mode      string
+		wantReal  counts
+		wantWould counts
+	}{
+		{name: "enforce", mode: modeEnforce, wantReal: counts{1, 2, 3}},
+		{name: "observe", mode: modeObserve, wantWould: counts{1, 2, 3}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := createDefaultConfig().(*Config)
+			cfg.Mode = tt.mode
+			p, err := newCardinalityLimiterProcessor(zap.NewNop(), cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			mc := p.newMetricContext("requests", tenantRef{})
+			mc.batch.record(0.1, decisionAggregate)
+			for i := 0; i < 2; i++ {
+				mc.batch.record(0.1, decisionOverflow)
+			}
+			for i := 0; i < 3; i++ {
+				mc.batch.record(0.1, decisionDrop)
+			}
+			p.flushMetricBatch(mc)
+
+			p.statsMutex.RLock()
+			defer p.statsMutex.RUnlock()
+			stats := mc.stats
+			if got := (counts{stats.aggregated, stats.overflowed, stats.dropped}); got != tt.wantReal {
+				t.Errorf("aggregated, overflowed, dropped = %v, want %v", got, tt.wantReal)
+			}
+			if got := (counts{stats.wouldAggregate, stats.wouldOverflow, stats.wouldDrop}); got != tt.wantWould {
+				t.Errorf("would aggregate, overflow, drop = %v, want %v", got, tt.wantWould)
+			}
+		})
+	}
+}
@@ -2,13 +2,25 @@ package main
 
 import (
 	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
 	"hash/fnv"
 	"math"
+	"net"
+	"net/http"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"go.opentelemetry.io/collector/component"
+	"go.opentelemetry.io/collector/consumer"
+	"go.opentelemetry.io/collector/pdata/pcommon"
 	"go.opentelemetry.io/collector/pdata/pmetric"
 	"go.opentelemetry.io/collector/processor"
+	"go.opentelemetry.io/collector/processor/processorhelper"
 	"go.uber.org/zap"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -21,17 +33,168 @@ type Config struct {
 	HighScore      float64  `mapstructure:"high_score"`
 	CriticalScore  float64  `mapstructure:"critical_score"`
 	AggregateLabels []string `mapstructure:"aggregate_labels"`
+
+	// Mode is "enforce" to limit data or "observe" to only report what the
+	// limiter would do while forwarding data unmodified
+	Mode string `mapstructure:"mode"`
+
+	// LimitAction decides what happens to datapoints over the limit: "drop"
+	// removes them, "overflow" folds them into one overflow series per metric
+	LimitAction string `mapstructure:"limit_action"`
+
+	// StateFile persists the series tracker across restarts when set
+	StateFile        string        `mapstructure:"state_file"`
+	SnapshotInterval time.Duration `mapstructure:"snapshot_interval"`
+
+	// SeriesTTL expires keys that have not been seen for this long. Keys are
+	// checked every SeriesTTL/2, clamped between a second and a minute
+	SeriesTTL time.Duration `mapstructure:"series_ttl"`
+
+	// ProtectedLabels are never stripped, ProtectedMetrics (exact names, or
+	// regular expressions prefixed with "regex:") are never dropped and
+	// AlwaysDropLabels are removed from every datapoint regardless of its score
+	ProtectedLabels  []string `mapstructure:"protected_labels"`
+	ProtectedMetrics []string `mapstructure:"protected_metrics"`
+	AlwaysDropLabels []string `mapstructure:"always_drop_labels"`
+
+	// Normalize rewrites label values, in order, before series identity is
+	// computed
+	Normalize []NormalizeRule `mapstructure:"normalize"`
+
+	// Attributes bounds attribute cardinality on log records and spans
+	Attributes AttributeLimitConfig `mapstructure:"attributes"`
+
+	// AutoAggregate selects exploding labels of metrics over budget
+	AutoAggregate AutoAggregateConfig `mapstructure:"auto_aggregate"`
+
+	// Budgets limits series per tenant on top of MaxKeys
+	Budgets BudgetConfig `mapstructure:"budgets"`
+
+	// UsageMetrics emits the limiter's usage into the metrics pipeline
+	UsageMetrics UsageMetricsConfig `mapstructure:"usage_metrics"`
+
+	// DebugEndpoint serves the top offenders page when set, e.g.
+	// "localhost:55679"
+	DebugEndpoint string `mapstructure:"debug_endpoint"`
+}
+
+const (
+	limitActionDrop     = "drop"
+	limitActionOverflow = "overflow"
+
+	// overflowAttribute marks the series that over-limit datapoints fold into
+	overflowAttribute = "otel.metric.overflow"
+)
+
+// limitDecision is the outcome of limiting a single datapoint
+type limitDecision int
+
+const (
+	decisionKeep limitDecision = iota
+	decisionAggregate
+	decisionOverflow
+	decisionDrop
+)
+
+// String returns the name used for a decision in metrics and debug output
+func (d limitDecision) String() string {
+	switch d {
+	case decisionAggregate:
+		return "aggregate"
+	case decisionOverflow:
+		return "overflow"
+	case decisionDrop:
+		return "drop"
+	default:
+		return "keep"
+	}
+}
+
+// seriesEntry is the tracker state kept for every key
+type seriesEntry struct {
+	count    uint64
+	lastSeen int64  // Unix nanoseconds
+	metric   uint32 // Index into metricStats
+	tenant   uint32 // Index into tenantStats
+}
+
+// metricStats is the limiter activity recorded for one metric name. Series is
+// updated atomically, everything else under statsMutex.
+type metricStats struct {
+	name       string
+	series     atomic.Int64
+	lastScore  float64
+	maxScore   float64
+	aggregated uint64
+	overflowed uint64
+	dropped    uint64
+
+	// budgetDropped is the part of dropped that was over a tenant budget
+	budgetDropped uint64
+
+	// wouldDrop counts what observe mode would have dropped, of which
+	// budgetWouldDrop was over a tenant budget
+	wouldDrop       uint64
+	budgetWouldDrop uint64
+
+	// wouldAggregate and wouldOverflow count what observe mode would have
+	// aggregated and sent to the overflow series
+	wouldAggregate uint64
+	wouldOverflow  uint64
+
+	// Labels selected for aggregation and the sketches that select them
+	autoLabels []string
+	growth     map[string]*labelSketch
 }
 
 type cardinalityLimiterProcessor struct {
+	id             component.ID
 	logger         *zap.Logger
 	config         *Config
-	keyMap         map[uint64]int
-	keyMapMutex    sync.RWMutex
+	tracker        *seriesTracker
+	labelSketches  map[string]*labelSketch
+	metricIDs      map[string]uint32
+	metricStats    []*metricStats
+	tenantIDs      map[string]uint32
+	tenantStats    []*tenantStats
+	growthSketches int
+	statsMutex     sync.RWMutex
+
+	// Usage metrics go to the first metrics pipeline's next consumer
+	startTime     time.Time
+	usageConsumer consumer.Metrics
+
+	// Sampled recent decisions and the page showing them
+	decisions   *decisionLog
+	debugServer *http.Server
+
+	// Label and metric contracts
+	protectedLabels  map[string]struct{}
+	protectedMetrics *metricMatcher
+	normalizer       *normalizer
+
+	// Distinct values per log and span attribute key
+	attributeValues map[string]map[uint64]int64
+	attributeMutex  sync.Mutex
+
+	// Background snapshot and expiry loops, run once for all pipelines
+	// sharing this processor
+	lifecycleMutex   sync.Mutex
+	starts           int
+	backgroundCancel context.CancelFunc
+	backgroundWg     sync.WaitGroup
 
 	// Metrics
-	droppedSamples *prometheus.CounterVec
-	keysUsed       prometheus.Gauge
+	droppedSamples  *prometheus.CounterVec
+	overflowSamples *prometheus.CounterVec
+	expiredKeys     prometheus.Counter
+	keysUsed        prometheus.Gauge
+	limitedAttrs    *prometheus.CounterVec
+	tenantKeysUsed  *prometheus.GaugeVec
+	tenantDropped   *prometheus.CounterVec
+	observedSamples *prometheus.CounterVec
+	observedAttrs   *prometheus.CounterVec
+	autoLabels      *prometheus.GaugeVec
 }
 
 // metrics
@@ -43,6 +206,19 @@ var (
 		},
 		[]string{"metric"},
 	)
+	overflowSamplesMetric = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cl_overflow_samples_total",
+			Help: "Total number of samples folded into overflow series by the cardinality limiter",
+		},
+		[]string{"metric"},
+	)
+	expiredKeysMetric = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cl_expired_keys_total",
+			Help: "Total number of keys expired by the cardinality limiter after not being seen for series_ttl",
+		},
+	)
 	keysUsedMetric = promauto.NewGauge(
 		prometheus.GaugeOpts{
 			Name: "cl_keys_used",
@@ -52,160 +228,560 @@ var (
 )
 
 // newCardinalityLimiterProcessor creates a processor for limiting cardinality
-func newCardinalityLimiterProcessor(logger *zap.Logger, config *Config) *cardinalityLimiterProcessor {
-	if config.MaxKeys <= 0 {
-		config.MaxKeys = 65536 // Default to 64k if not specified
+func newCardinalityLimiterProcessor(logger *zap.Logger, config *Config) (*cardinalityLimiterProcessor, error) {
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid cardinality limiter config: %v", err)
+	}
+
+	protectedMetrics, err := newMetricMatcher(config.ProtectedMetrics)
+	if err != nil {
+		return nil, err
 	}
-	if config.HighScore <= 0 {
-		config.HighScore = 0.75
+	protectedLabels := make(map[string]struct{}, len(config.ProtectedLabels))
+	for _, label := range config.ProtectedLabels {
+		protectedLabels[label] = struct{}{}
 	}
-	if config.CriticalScore <= 0 {
-		config.CriticalScore = 0.90
+	normalizer, err := newNormalizer(config.Normalize, protectedLabels)
+	if err != nil {
+		return nil, err
 	}
 
 	return &cardinalityLimiterProcessor{
-		logger:         logger,
-		config:         config,
-		keyMap:         make(map[uint64]int, config.MaxKeys),
-		droppedSamples: droppedSamplesMetric,
-		keysUsed:       keysUsedMetric,
+		logger:           logger,
+		config:           config,
+		tracker:          newSeriesTracker(config.MaxKeys),
+		startTime:        time.Now(),
+		labelSketches:    make(map[string]*labelSketch),
+		attributeValues:  make(map[string]map[uint64]int64),
+		metricIDs:        make(map[string]uint32),
+		tenantIDs:        make(map[string]uint32),
+		decisions:        newDecisionLog(),
+		protectedLabels:  protectedLabels,
+		protectedMetrics: protectedMetrics,
+		normalizer:       normalizer,
+		droppedSamples:   droppedSamplesMetric,
+		overflowSamples:  overflowSamplesMetric,
+		expiredKeys:      expiredKeysMetric,
+		keysUsed:         keysUsedMetric,
+		limitedAttrs:     limitedAttributesMetric,
+		tenantKeysUsed:   tenantKeysUsedMetric,
+		tenantDropped:    tenantDroppedSamplesMetric,
+		observedSamples:  observedSamplesMetric,
+		observedAttrs:    observedAttributesMetric,
+		autoLabels:       autoAggregatedLabelsMetric,
+	}, nil
+}
+
+// start restores the last state snapshot and launches the background loops.
+// Only the first pipeline to start the shared processor does any work.
+func (p *cardinalityLimiterProcessor) start(ctx context.Context, host component.Host) error {
+	p.lifecycleMutex.Lock()
+	defer p.lifecycleMutex.Unlock()
+
+	p.starts++
+	if p.starts > 1 {
+		return nil
+	}
+
+	if p.config.DebugEndpoint != "" {
+		if err := p.startDebugServer(); err != nil {
+			return fmt.Errorf("failed to start debug server: %v", err)
+		}
+	}
+
+	backgroundCtx, cancel := context.WithCancel(context.Background())
+	p.backgroundCancel = cancel
+
+	if p.config.StateFile != "" {
+		if err := p.loadState(); err != nil {
+			p.logger.Warn("Ignoring unreadable cardinality limiter state",
+				zap.String("file", p.config.StateFile),
+				zap.Error(err))
+		}
+		p.backgroundWg.Add(1)
+		go p.snapshotLoop(backgroundCtx)
+	}
+
+	// Expire anything that went stale while the collector was down
+	p.expireKeys()
+	p.backgroundWg.Add(1)
+	go p.expiryLoop(backgroundCtx)
+
+	if p.config.UsageMetrics.Enabled && p.usageConsumer != nil {
+		p.backgroundWg.Add(1)
+		go p.usageLoop(backgroundCtx)
+	}
+
+	return nil
+}
+
+// shutdown stops the background loops and writes a final state snapshot once
+// the last pipeline sharing the processor shuts down
+func (p *cardinalityLimiterProcessor) shutdown(ctx context.Context) error {
+	p.lifecycleMutex.Lock()
+	defer p.lifecycleMutex.Unlock()
+
+	p.starts--
+	if p.starts > 0 || p.backgroundCancel == nil {
+		return nil
+	}
+	releaseProcessor(p)
+
+	if err := p.stopDebugServer(ctx); err != nil {
+		p.logger.Warn("Failed to stop debug server", zap.Error(err))
+	}
+
+	p.backgroundCancel()
+	p.backgroundWg.Wait()
+	p.backgroundCancel = nil
+
+	if p.config.StateFile == "" {
+		return nil
 	}
+	return p.saveState()
 }
 
 // processMetrics implements the ProcessMetricsFunc type
 func (p *cardinalityLimiterProcessor) processMetrics(ctx context.Context, md pmetric.Metrics) (pmetric.Metrics, error) {
 	rm := md.ResourceMetrics()
 	for i := 0; i < rm.Len(); i++ {
+		tenant := p.resolveTenant(rm.At(i).Resource())
 		ilm := rm.At(i).ScopeMetrics()
 		for j := 0; j < ilm.Len(); j++ {
 			metrics := ilm.At(j).Metrics()
 			for k := 0; k < metrics.Len(); k++ {
 				metric := metrics.At(k)
-				metricName := metric.Name()
+				mc := p.newMetricContext(metric.Name(), tenant)
 				
-				// Process each metric type
+				// Process each metric type. When labels were stripped from any
+				// datapoint or it was moved to the overflow series, fold the
+				// resulting duplicates back into one point per identity.
 				switch metric.Type() {
 				case pmetric.MetricTypeGauge:
-					p.processDataPoints(metricName, metric.Gauge().DataPoints())
+					dps := metric.Gauge().DataPoints()
+					if origIDs := p.processDataPoints(mc, dps); origIDs != nil {
+						mergeGaugeDataPoints(dps)
+					}
 				case pmetric.MetricTypeSum:
-					p.processDataPoints(metricName, metric.Sum().DataPoints())
+					dps := metric.Sum().DataPoints()
+					if origIDs := p.processDataPoints(mc, dps); origIDs != nil {
+						mergeSumDataPoints(dps, metric.Sum().AggregationTemporality(), origIDs)
+					}
 				case pmetric.MetricTypeHistogram:
-					p.processHistogramDataPoints(metricName, metric.Histogram().DataPoints())
+					dps := metric.Histogram().DataPoints()
+					if origIDs := p.processHistogramDataPoints(mc, dps); origIDs != nil {
+						mergeHistogramDataPoints(dps, metric.Histogram().AggregationTemporality(), origIDs)
+					}
+				case pmetric.MetricTypeExponentialHistogram:
+					dps := metric.ExponentialHistogram().DataPoints()
+					if origIDs := p.processExponentialHistogramDataPoints(mc, dps); origIDs != nil {
+						mergeExponentialHistogramDataPoints(dps, metric.ExponentialHistogram().AggregationTemporality(), origIDs)
+					}
 				case pmetric.MetricTypeSummary:
-					p.processSummaryDataPoints(metricName, metric.Summary().DataPoints())
+					dps := metric.Summary().DataPoints()
+					if origIDs := p.processSummaryDataPoints(mc, dps); origIDs != nil {
+						mergeSummaryDataPoints(dps, origIDs)
+					}
 				}
+				p.flushMetricBatch(mc)
 			}
 		}
 	}
 	
 	// Update keys used metric
-	p.keyMapMutex.RLock()
-	p.keysUsed.Set(float64(len(p.keyMap)))
-	p.keyMapMutex.RUnlock()
+	p.keysUsed.Set(float64(p.tracker.len()))
+	p.statsMutex.RLock()
+	p.updateTenantGauges()
+	p.statsMutex.RUnlock()
 	
 	return md, nil
 }
 
-// processDataPoints handles number datapoints (gauge and sum)
-func (p *cardinalityLimiterProcessor) processDataPoints(metricName string, dps pmetric.NumberDataPointSlice) {
+// processDataPoints handles number datapoints (gauge and sum). Dropped
+// datapoints are removed from the slice. It returns the identity each
+// remaining datapoint had before label aggregation, or nil if no labels were
+// stripped and the slice needs no merging.
+func (p *cardinalityLimiterProcessor) processDataPoints(mc metricContext, dps pmetric.NumberDataPointSlice) []uint64 {
+	origIDs := make([]uint64, dps.Len())
+	drop := make([]bool, dps.Len())
+	merge, dropped := false, false
 	for i := 0; i < dps.Len(); i++ {
-		dp := dps.At(i)
-		score := p.calculateEntropyScore(dp.Attributes())
-		
-		if score >= p.config.CriticalScore {
-			// Critical score - drop the sample
-			p.droppedSamples.WithLabelValues(metricName).Inc()
-			// Mark for removal (we'll handle this in a future implementation)
-			// For now, we're just counting drops
-		} else if score >= p.config.HighScore {
-			// High score - aggregate by removing specified labels
-			for _, labelToRemove := range p.config.AggregateLabels {
-				dp.Attributes().Remove(labelToRemove)
-			}
-		}
-		
-		// Track key hash in map
-		hash := p.hashAttributes(dp.Attributes())
-		p.keyMapMutex.Lock()
-		p.keyMap[hash]++
-		
-		// Check if we need to evict
-		if len(p.keyMap) > p.config.MaxKeys {
-			// For now, simple approach: remove a random key
-			// TODO: Implement LRU or heat-weighted eviction
-			for k := range p.keyMap {
-				delete(p.keyMap, k)
-				break
-			}
+		var decision limitDecision
+		origIDs[i], decision = p.limitDataPoint(mc, dps.At(i).Attributes())
+		switch decision {
+		case decisionAggregate, decisionOverflow:
+			merge = true
+		case decisionDrop:
+			drop[i] = true
+			dropped = true
 		}
-		p.keyMapMutex.Unlock()
 	}
+	if dropped {
+		origIDs = removeDropped(drop, origIDs, dps.RemoveIf)
+	}
+	if !merge {
+		return nil
+	}
+	return origIDs
 }
 
 // processHistogramDataPoints handles histogram datapoints
-func (p *cardinalityLimiterProcessor) processHistogramDataPoints(metricName string, dps pmetric.HistogramDataPointSlice) {
+func (p *cardinalityLimiterProcessor) processHistogramDataPoints(mc metricContext, dps pmetric.HistogramDataPointSlice) []uint64 {
+	origIDs := make([]uint64, dps.Len())
+	drop := make([]bool, dps.Len())
+	merge, dropped := false, false
 	for i := 0; i < dps.Len(); i++ {
-		dp := dps.At(i)
-		score := p.calculateEntropyScore(dp.Attributes())
-		
-		if score >= p.config.CriticalScore {
-			// Critical score - drop the sample
-			p.droppedSamples.WithLabelValues(metricName).Inc()
-			// Mark for removal (in future implementation)
-		} else if score >= p.config.HighScore {
-			// High score - aggregate by removing specified labels
-			for _, labelToRemove := range p.config.AggregateLabels {
-				dp.Attributes().Remove(labelToRemove)
-			}
+		var decision limitDecision
+		origIDs[i], decision = p.limitDataPoint(mc, dps.At(i).Attributes())
+		switch decision {
+		case decisionAggregate, decisionOverflow:
+			merge = true
+		case decisionDrop:
+			drop[i] = true
+			dropped = true
 		}
-		
-		// Track key hash in map (same logic as above)
-		hash := p.hashAttributes(dp.Attributes())
-		p.keyMapMutex.Lock()
-		p.keyMap[hash]++
-		if len(p.keyMap) > p.config.MaxKeys {
-			for k := range p.keyMap {
-				delete(p.keyMap, k)
-				break
-			}
+	}
+	if dropped {
+		origIDs = removeDropped(drop, origIDs, dps.RemoveIf)
+	}
+	if !merge {
+		return nil
+	}
+	return origIDs
+}
+
+// processExponentialHistogramDataPoints handles exponential histogram datapoints
+func (p *cardinalityLimiterProcessor) processExponentialHistogramDataPoints(mc metricContext, dps pmetric.ExponentialHistogramDataPointSlice) []uint64 {
+	origIDs := make([]uint64, dps.Len())
+	drop := make([]bool, dps.Len())
+	merge, dropped := false, false
+	for i := 0; i < dps.Len(); i++ {
+		var decision limitDecision
+		origIDs[i], decision = p.limitDataPoint(mc, dps.At(i).Attributes())
+		switch decision {
+		case decisionAggregate, decisionOverflow:
+			merge = true
+		case decisionDrop:
+			drop[i] = true
+			dropped = true
 		}
-		p.keyMapMutex.Unlock()
 	}
+	if dropped {
+		origIDs = removeDropped(drop, origIDs, dps.RemoveIf)
+	}
+	if !merge {
+		return nil
+	}
+	return origIDs
 }
 
 // processSummaryDataPoints handles summary datapoints
-func (p *cardinalityLimiterProcessor) processSummaryDataPoints(metricName string, dps pmetric.SummaryDataPointSlice) {
+func (p *cardinalityLimiterProcessor) processSummaryDataPoints(mc metricContext, dps pmetric.SummaryDataPointSlice) []uint64 {
+	origIDs := make([]uint64, dps.Len())
+	drop := make([]bool, dps.Len())
+	merge, dropped := false, false
 	for i := 0; i < dps.Len(); i++ {
-		dp := dps.At(i)
-		score := p.calculateEntropyScore(dp.Attributes())
-		
-		if score >= p.config.CriticalScore {
-			// Critical score - drop the sample
-			p.droppedSamples.WithLabelValues(metricName).Inc()
-			// Mark for removal (in future implementation)
-		} else if score >= p.config.HighScore {
-			// High score - aggregate by removing specified labels
-			for _, labelToRemove := range p.config.AggregateLabels {
-				dp.Attributes().Remove(labelToRemove)
+		var decision limitDecision
+		origIDs[i], decision = p.limitDataPoint(mc, dps.At(i).Attributes())
+		switch decision {
+		case decisionAggregate, decisionOverflow:
+			merge = true
+		case decisionDrop:
+			drop[i] = true
+			dropped = true
+		}
+	}
+	if dropped {
+		origIDs = removeDropped(drop, origIDs, dps.RemoveIf)
+	}
+	if !merge {
+		return nil
+	}
+	return origIDs
+}
+
+// metricContext carries the per-metric inputs to limiting decisions and
+// collects the batch's activity for the metric
+type metricContext struct {
+	name      string
+	id        uint32
+	stats     *metricStats
+	hash      uint64
+	protected bool
+	tenant    tenantRef
+	now       time.Time
+	batch     *metricBatch
+
+	// autoLabels is shared with metricStats and must not be modified
+	autoLabels []string
+}
+
+// newMetricContext resolves the per-metric inputs for a metric name
+func (p *cardinalityLimiterProcessor) newMetricContext(name string, tenant tenantRef) metricContext {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+
+	p.statsMutex.RLock()
+	id, ok := p.metricIDs[name]
+	p.statsMutex.RUnlock()
+	if !ok {
+		p.statsMutex.Lock()
+		id = p.internMetric(name)
+		p.statsMutex.Unlock()
+	}
+
+	p.statsMutex.RLock()
+	stats := p.metricStats[id]
+	autoLabels := stats.autoLabels
+	p.statsMutex.RUnlock()
+
+	return metricContext{
+		name:       name,
+		id:         id,
+		stats:      stats,
+		hash:       h.Sum64() ^ tenant.hash,
+		protected:  p.protectedMetrics.matches(name),
+		tenant:     tenant,
+		now:        time.Now(),
+		batch:      newMetricBatch(),
+		autoLabels: autoLabels,
+	}
+}
+
+// internMetric returns the stats index of a metric name, adding it if needed.
+// Callers must hold statsMutex.
+func (p *cardinalityLimiterProcessor) internMetric(name string) uint32 {
+	if id, ok := p.metricIDs[name]; ok {
+		return id
+	}
+	id := uint32(len(p.metricStats))
+	p.metricIDs[name] = id
+	p.metricStats = append(p.metricStats, &metricStats{name: name})
+	return id
+}
+
+// flushMetricBatch applies a metric's batch to its statistics, sketches and
+// counters
+func (p *cardinalityLimiterProcessor) flushMetricBatch(mc metricContext) {
+	b := mc.batch
+	if p.observing() {
+		for decision, n := range b.observed {
+			if n > 0 {
+				p.observedSamples.WithLabelValues(mc.name, limitDecision(decision).String()).Add(float64(n))
+			}
+		}
+	} else {
+		if b.dropped > 0 {
+			p.droppedSamples.WithLabelValues(mc.name).Add(float64(b.dropped))
+			if mc.tenant.stats != nil {
+				p.tenantDropped.WithLabelValues(mc.tenant.name).Add(float64(b.dropped))
 			}
 		}
+		if b.overflowed > 0 {
+			p.overflowSamples.WithLabelValues(mc.name).Add(float64(b.overflowed))
+		}
+	}
+
+	p.statsMutex.Lock()
+	stats := mc.stats
+	if b.scored {
+		stats.lastScore = b.lastScore
+		if b.maxScore > stats.maxScore {
+			stats.maxScore = b.maxScore
+		}
+	}
+	if p.observing() {
+		stats.wouldAggregate += b.aggregated
+		stats.wouldOverflow += b.overflowed
+		stats.wouldDrop += b.dropped
+		stats.budgetWouldDrop += b.budgetDropped
+		if mc.tenant.stats != nil {
+			mc.tenant.stats.wouldDrop += b.dropped
+		}
+	} else {
+		stats.aggregated += b.aggregated
+		stats.overflowed += b.overflowed
+		stats.dropped += b.dropped
+		stats.budgetDropped += b.budgetDropped
+		if mc.tenant.stats != nil {
+			mc.tenant.stats.dropped += b.dropped
+		}
+	}
+	p.observeLabels(b.labels)
+	autoLabel := p.learnGrowth(mc, b.growth)
+	p.statsMutex.Unlock()
+
+	if autoLabel != "" {
+		p.reportAutoLabel(mc, autoLabel)
+	}
+	metricBatchPool.Put(b)
+}
+
+// decideDataPoint scores a single datapoint's attributes and decides whether
+// to keep it, aggregate labels away, move it to the overflow series or drop
+// it. Protected metrics are aggregated instead of dropped. Kept datapoints are
+// tracked under their resulting key. It returns the hash of the attributes
+// before any change together with the decision.
+func (p *cardinalityLimiterProcessor) decideDataPoint(mc metricContext, attrs pcommon.Map) (uint64, limitDecision) {
+	origID := p.hashAttributes(attrs)
+	decision := decisionKeep
+	
+	// Labels that must never reach the backend go first, then values are
+	// normalized so the series they collapse into get merged
+	for _, label := range p.config.AlwaysDropLabels {
+		if attrs.Remove(label) {
+			decision = decisionAggregate
+		}
+	}
+	if p.normalizer.normalize(attrs) {
+		decision = decisionAggregate
+	}
+	for _, label := range mc.autoLabels {
+		if attrs.Remove(label) {
+			decision = decisionAggregate
+		}
+	}
+	
+	score := p.calculateEntropyScore(attrs)
+	mc.batch.labels = appendLabelValues(mc.batch.labels, attrs, nil)
+	
+	// Decide before touching the attributes so the debug page can show
+	// what the datapoint looked like
+	scored := decisionKeep
+	if score >= p.config.CriticalScore && !mc.protected {
+		scored = decisionDrop
+		if p.config.LimitAction == limitActionOverflow {
+			scored = decisionOverflow
+		}
+	} else if score >= p.config.HighScore && hasAnyLabel(attrs, p.config.AggregateLabels) {
+		scored = decisionAggregate
+	}
+	if scored != decisionKeep {
+		p.recordDecision(mc, scored, reasonScore, score, attrs)
+	}
+	
+	switch scored {
+	case decisionDrop:
+		// Critical score - drop the sample
+		mc.batch.record(score, decisionDrop)
+		return origID, decisionDrop
+	case decisionOverflow:
+		// Critical score - fold the sample into the overflow series
+		p.foldIntoOverflow(attrs)
+		decision = decisionOverflow
+	case decisionAggregate:
+		// High score - aggregate by removing specified labels
+		for _, labelToRemove := range p.config.AggregateLabels {
+			attrs.Remove(labelToRemove)
+		}
+		decision = decisionAggregate
+	}
+	
+	hash := origID
+	if decision != decisionKeep {
+		hash = p.hashAttributes(attrs)
+	}
+	// Keys are per metric and tenant, so identical labels on two metrics
+	// are two series
+	key := (hash ^ mc.hash) * fnvPrime64
+	
+	checkBudget := decision != decisionOverflow && !mc.protected && mc.tenant.stats != nil
+	admitted, created := p.trackKey(mc, key, checkBudget)
+	if !admitted {
+		// The tenant's budget is full - this new series is over the limit
+		scored = decisionDrop
+		if p.config.LimitAction == limitActionOverflow {
+			scored = decisionOverflow
+		}
+		p.recordDecision(mc, scored, reasonBudget, score, attrs)
+		if scored == decisionDrop {
+			mc.batch.record(score, decisionDrop)
+			mc.batch.budgetDropped++
+			return origID, decisionDrop
+		}
 		
-		// Track key hash in map (same logic as above)
-		hash := p.hashAttributes(dp.Attributes())
-		p.keyMapMutex.Lock()
-		p.keyMap[hash]++
-		if len(p.keyMap) > p.config.MaxKeys {
-			for k := range p.keyMap {
-				delete(p.keyMap, k)
-				break
+		p.foldIntoOverflow(attrs)
+		decision = decisionOverflow
+		key = (p.hashAttributes(attrs) ^ mc.hash) * fnvPrime64
+		_, created = p.trackKey(mc, key, false)
+	}
+	mc.batch.record(score, scored)
+	if created && p.config.AutoAggregate.Enabled && len(mc.autoLabels) < p.config.AutoAggregate.MaxLabels {
+		mc.batch.growth = appendLabelValues(mc.batch.growth, attrs, p.protectedLabels)
+	}
+	
+	return origID, decision
+}
+
+// foldIntoOverflow rewrites a datapoint's attributes into the overflow
+// series, which still carries the protected labels
+func (p *cardinalityLimiterProcessor) foldIntoOverflow(attrs pcommon.Map) {
+	attrs.RemoveIf(func(k string, _ pcommon.Value) bool {
+		_, keep := p.protectedLabels[k]
+		return !keep
+	})
+	attrs.PutBool(overflowAttribute, true)
+}
+
+// recordDecision samples a decision for the debug page
+func (p *cardinalityLimiterProcessor) recordDecision(mc metricContext, decision limitDecision, reason string, score float64, attrs pcommon.Map) {
+	if !p.decisions.allow(mc.now) {
+		return
+	}
+	record := decisionRecord{
+		Time:     mc.now,
+		Metric:   mc.name,
+		Tenant:   mc.tenant.name,
+		Decision: decision.String(),
+		Reason:   reason,
+		Score:    score,
+		Labels:   formatAttributes(attrs),
+	}
+	p.decisions.add(record)
+	if p.observing() {
+		p.logObservedDecision(record)
+	}
+}
+
+// hasAnyLabel reports whether attrs contains any of the given labels
+func hasAnyLabel(attrs pcommon.Map, labels []string) bool {
+	for _, label := range labels {
+		if _, ok := attrs.Get(label); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// appendLabelValues appends the hashed value of every label not in skip
+func appendLabelValues(values []labelValue, attrs pcommon.Map, skip map[string]struct{}) []labelValue {
+	attrs.Range(func(k string, v pcommon.Value) bool {
+		if _, ok := skip[k]; !ok {
+			values = append(values, labelValue{label: k, hash: sketchHash(v.AsString())})
+		}
+		return true
+	})
+	return values
+}
+
+// observeLabels records each label value in its label's distinct-value
+// sketch. Callers must hold statsMutex.
+func (p *cardinalityLimiterProcessor) observeLabels(values []labelValue) {
+	for _, v := range values {
+		sketch, ok := p.labelSketches[v.label]
+		if !ok {
+			if len(p.labelSketches) >= maxLabelSketches || len(v.label) > math.MaxUint16 {
+				continue
 			}
+			sketch = &labelSketch{}
+			p.labelSketches[v.label] = sketch
 		}
-		p.keyMapMutex.Unlock()
+		sketch.addHash(v.hash)
 	}
 }
 
 // calculateEntropyScore computes the entropy-based score for a set of attributes
-func (p *cardinalityLimiterProcessor) calculateEntropyScore(attrs pmetric.Map) float64 {
+func (p *cardinalityLimiterProcessor) calculateEntropyScore(attrs pcommon.Map) float64 {
 	// For this MVP, we'll use a simplistic approach:
 	// Count the number of attributes and their total length as a proxy for entropy
 	attrCount := attrs.Len()
@@ -214,7 +790,7 @@ func (p *cardinalityLimiterProcessor) calculateEntropyScore(attrs pmetric.Map) f
 	}
 
 	totalChars := 0
-	attrs.Range(func(k string, v pmetric.Value) bool {
+	attrs.Range(func(k string, v pcommon.Value) bool {
 		totalChars += len(k) + len(v.AsString())
 		return true
 	})
@@ -227,38 +803,95 @@ func (p *cardinalityLimiterProcessor) calculateEntropyScore(attrs pmetric.Map) f
 }
 
 // hashAttributes creates a FNV-1a 64-bit hash of the attributes
-func (p *cardinalityLimiterProcessor) hashAttributes(attrs pmetric.Map) uint64 {
+func (p *cardinalityLimiterProcessor) hashAttributes(attrs pcommon.Map) uint64 {
+	return hashAttributeMap(attrs)
+}
+
+// fnvPrime64 is the FNV-1a 64-bit prime, used to fold extra values into a hash
+const fnvPrime64 = 1099511628211
+
+// hashAttributeMap creates a FNV-1a 64-bit hash of the attributes
+func hashAttributeMap(attrs pcommon.Map) uint64 {
 	h := fnv.New64a()
 	
 	// Sort keys for deterministic hashing
 	keys := make([]string, 0, attrs.Len())
-	attrs.Range(func(k string, v pmetric.Value) bool {
+	attrs.Range(func(k string, v pcommon.Value) bool {
 		keys = append(keys, k)
 		return true
 	})
 	
-	// Sort keys (we'll implement this in a real version)
-	// sort.Strings(keys)
+	// Datapoint merging relies on identical attributes sharing a hash
+	sort.Strings(keys)
 	
-	// Hash each key-value pair
+	// Hash each key-value pair. Fields are length-prefixed and values carry
+	// their type, so {"a": "bc"} and {"ab": "c"} or "1" and 1 never collide
 	for _, k := range keys {
 		v, _ := attrs.Get(k)
-		h.Write([]byte(k))
-		h.Write([]byte(v.AsString()))
+		writeHashField(h, k)
+		h.Write([]byte{byte(v.Type())})
+		writeHashField(h, v.AsString())
 	}
 	
 	return h.Sum64()
 }
 
+// writeHashField writes a length-prefixed string into a hash
+func writeHashField(h hash.Hash64, s string) {
+	var size [8]byte
+	binary.LittleEndian.PutUint64(size[:], uint64(len(s)))
+	h.Write(size[:])
+	h.Write([]byte(s))
+}
+
 // newFactory creates a factory for the cardinality limiter processor
 func NewFactory() processor.Factory {
 	return processor.NewFactory(
 		"cardinalitylimiter",
 		createDefaultConfig,
-		processor.WithMetrics(createMetricsProcessor),
+		processor.WithMetrics(createMetricsProcessor, component.StabilityLevelDevelopment),
+		processor.WithLogs(createLogsProcessor, component.StabilityLevelDevelopment),
+		processor.WithTraces(createTracesProcessor, component.StabilityLevelDevelopment),
 	)
 }
 
+// sharedProcessors holds one limiter per component ID, so every pipeline
+// using the same processor shares its tracker and state file
+var (
+	sharedProcessors      = map[component.ID]*cardinalityLimiterProcessor{}
+	sharedProcessorsMutex sync.Mutex
+)
+
+// getOrCreateProcessor returns the limiter for a component ID, creating it on
+// first use
+func getOrCreateProcessor(set processor.CreateSettings, cfg *Config) (*cardinalityLimiterProcessor, error) {
+	sharedProcessorsMutex.Lock()
+	defer sharedProcessorsMutex.Unlock()
+
+	if p, ok := sharedProcessors[set.ID]; ok {
+		return p, nil
+	}
+
+	p, err := newCardinalityLimiterProcessor(set.Logger, cfg)
+	if err != nil {
+		return nil, err
+	}
+	p.id = set.ID
+	sharedProcessors[set.ID] = p
+	return p, nil
+}
+
+// releaseProcessor forgets a shut down limiter so a restarted pipeline
+// builds a fresh one
+func releaseProcessor(p *cardinalityLimiterProcessor) {
+	sharedProcessorsMutex.Lock()
+	defer sharedProcessorsMutex.Unlock()
+
+	if sharedProcessors[p.id] == p {
+		delete(sharedProcessors, p.id)
+	}
+}
+
 // createDefaultConfig creates the default configuration for the processor
 func createDefaultConfig() component.Config {
 	return &Config{
@@ -266,6 +899,26 @@ func createDefaultConfig() component.Config {
 		HighScore:      0.75,
 		CriticalScore:  0.90,
 		AggregateLabels: []string{"container.image.tag", "k8s.pod.uid"},
+		Mode:            modeEnforce,
+		LimitAction:     limitActionDrop,
+		SnapshotInterval: defaultSnapshotInterval,
+		SeriesTTL:        defaultSeriesTTL,
+		AutoAggregate: AutoAggregateConfig{
+			MetricBudget: defaultMetricBudget,
+			MaxLabels:    defaultMaxAutoLabels,
+		},
+		Budgets: BudgetConfig{
+			Default: defaultTenantBudget,
+		},
+		UsageMetrics: UsageMetricsConfig{
+			Interval:   defaultUsageInterval,
+			MaxMetrics: defaultUsageMaxMetrics,
+		},
+		Attributes: AttributeLimitConfig{
+			MaxValuesPerKey: defaultMaxValuesPerKey,
+			Action:          attributeActionRedact,
+			HashBuckets:     defaultHashBuckets,
+		},
 	}
 }
 
@@ -274,13 +927,62 @@ func createMetricsProcessor(
 	ctx context.Context,
 	set processor.CreateSettings,
 	cfg component.Config,
-	nextConsumer component.Metrics,
+	nextConsumer consumer.Metrics,
 ) (processor.Metrics, error) {
 	pCfg := cfg.(*Config)
-	metricsProcessor := newCardinalityLimiterProcessor(set.Logger, pCfg)
+	metricsProcessor, err := getOrCreateProcessor(set, pCfg)
+	if err != nil {
+		return nil, err
+	}
+	if metricsProcessor.usageConsumer == nil {
+		metricsProcessor.usageConsumer = nextConsumer
+	}
+
+	return processorhelper.NewMetricsProcessor(ctx, set, cfg, nextConsumer,
+		metricsProcessor.processMetrics,
+		processorhelper.WithCapabilities(consumer.Capabilities{MutatesData: true}),
+		processorhelper.WithStart(metricsProcessor.start),
+		processorhelper.WithShutdown(metricsProcessor.shutdown))
+}
+
+// createLogsProcessor creates a processor for log record attributes
+func createLogsProcessor(
+	ctx context.Context,
+	set processor.CreateSettings,
+	cfg component.Config,
+	nextConsumer consumer.Logs,
+) (processor.Logs, error) {
+	pCfg := cfg.(*Config)
+	logsProcessor, err := getOrCreateProcessor(set, pCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return processorhelper.NewLogsProcessor(ctx, set, cfg, nextConsumer,
+		logsProcessor.processLogs,
+		processorhelper.WithCapabilities(consumer.Capabilities{MutatesData: true}),
+		processorhelper.WithStart(logsProcessor.start),
+		processorhelper.WithShutdown(logsProcessor.shutdown))
+}
+
+// createTracesProcessor creates a processor for span attributes
+func createTracesProcessor(
+	ctx context.Context,
+	set processor.CreateSettings,
+	cfg component.Config,
+	nextConsumer consumer.Traces,
+) (processor.Traces, error) {
+	pCfg := cfg.(*Config)
+	tracesProcessor, err := getOrCreateProcessor(set, pCfg)
+	if err != nil {
+		return nil, err
+	}
 
-	return processor.NewMetricsProcessor(ctx, set, cfg, nextConsumer,
-		metricsProcessor.processMetrics)
+	return processorhelper.NewTracesProcessor(ctx, set, cfg, nextConsumer,
+		tracesProcessor.processTraces,
+		processorhelper.WithCapabilities(consumer.Capabilities{MutatesData: true}),
+		processorhelper.WithStart(tracesProcessor.start),
+		processorhelper.WithShutdown(tracesProcessor.shutdown))
 }
 
 // This is the plugin entry point
@@ -288,9 +990,134 @@ var (
 	_ component.ConfigValidator = (*Config)(nil)
 )
 
-// Validate validates the processor configuration
+// Validate validates the processor configuration. Defaults come from
+// createDefaultConfig, so zero values left in place are errors too.
 func (cfg *Config) Validate() error {
-	return nil
+	var errs []error
+
+	if cfg.MaxKeys <= 0 {
+		errs = append(errs, fmt.Errorf("max_keys must be positive, got %d", cfg.MaxKeys))
+	}
+	if cfg.HighScore <= 0 || cfg.HighScore > 1 {
+		errs = append(errs, fmt.Errorf("high_score must be in (0, 1], got %v", cfg.HighScore))
+	}
+	if cfg.CriticalScore <= 0 || cfg.CriticalScore > 1 {
+		errs = append(errs, fmt.Errorf("critical_score must be in (0, 1], got %v", cfg.CriticalScore))
+	}
+	if cfg.HighScore >= cfg.CriticalScore {
+		errs = append(errs, fmt.Errorf("high_score (%v) must be less than critical_score (%v)", cfg.HighScore, cfg.CriticalScore))
+	}
+
+	switch cfg.Mode {
+	case modeEnforce, modeObserve:
+	default:
+		errs = append(errs, fmt.Errorf("mode must be %q or %q, got %q", modeEnforce, modeObserve, cfg.Mode))
+	}
+	switch cfg.LimitAction {
+	case limitActionDrop, limitActionOverflow:
+	default:
+		errs = append(errs, fmt.Errorf("limit_action must be %q or %q, got %q", limitActionDrop, limitActionOverflow, cfg.LimitAction))
+	}
+
+	if cfg.SnapshotInterval <= 0 {
+		errs = append(errs, fmt.Errorf("snapshot_interval must be positive, got %v", cfg.SnapshotInterval))
+	}
+	if cfg.SeriesTTL <= 0 {
+		errs = append(errs, fmt.Errorf("series_ttl must be positive, got %v", cfg.SeriesTTL))
+	}
+
+	errs = append(errs, validateLabels("aggregate_labels", cfg.AggregateLabels)...)
+	errs = append(errs, validateLabels("protected_labels", cfg.ProtectedLabels)...)
+	errs = append(errs, validateLabels("always_drop_labels", cfg.AlwaysDropLabels)...)
+
+	protected := make(map[string]struct{}, len(cfg.ProtectedLabels))
+	for _, label := range cfg.ProtectedLabels {
+		protected[label] = struct{}{}
+	}
+	for _, label := range cfg.AggregateLabels {
+		if _, ok := protected[label]; ok {
+			errs = append(errs, fmt.Errorf("label %q is both protected and in aggregate_labels", label))
+		}
+	}
+	for _, label := range cfg.AlwaysDropLabels {
+		if _, ok := protected[label]; ok {
+			errs = append(errs, fmt.Errorf("label %q is both protected and in always_drop_labels", label))
+		}
+	}
+
+	if _, err := newMetricMatcher(cfg.ProtectedMetrics); err != nil {
+		errs = append(errs, err)
+	}
+	for i, rule := range cfg.Normalize {
+		errs = append(errs, validateLabels(fmt.Sprintf("normalize[%d]::labels", i), rule.Labels)...)
+	}
+	if _, err := newNormalizer(cfg.Normalize, protected); err != nil {
+		errs = append(errs, err)
+	}
+
+	if cfg.Attributes.MaxValuesPerKey <= 0 {
+		errs = append(errs, fmt.Errorf("attributes::max_values_per_key must be positive, got %d", cfg.Attributes.MaxValuesPerKey))
+	}
+	switch cfg.Attributes.Action {
+	case attributeActionRedact, attributeActionHashBucket, attributeActionDrop:
+	default:
+		errs = append(errs, fmt.Errorf("attributes::action must be %q, %q or %q, got %q",
+			attributeActionRedact, attributeActionHashBucket, attributeActionDrop, cfg.Attributes.Action))
+	}
+	if cfg.Attributes.HashBuckets <= 0 {
+		errs = append(errs, fmt.Errorf("attributes::hash_buckets must be positive, got %d", cfg.Attributes.HashBuckets))
+	}
+
+	if cfg.AutoAggregate.MetricBudget <= 0 {
+		errs = append(errs, fmt.Errorf("auto_aggregate::metric_budget must be positive, got %d", cfg.AutoAggregate.MetricBudget))
+	} else if cfg.AutoAggregate.Enabled && cfg.MaxKeys > 0 && cfg.AutoAggregate.MetricBudget > cfg.MaxKeys {
+		errs = append(errs, fmt.Errorf("auto_aggregate::metric_budget (%d) exceeds max_keys (%d)", cfg.AutoAggregate.MetricBudget, cfg.MaxKeys))
+	}
+	if cfg.AutoAggregate.MaxLabels <= 0 {
+		errs = append(errs, fmt.Errorf("auto_aggregate::max_labels must be positive, got %d", cfg.AutoAggregate.MaxLabels))
+	}
+
+	if cfg.Budgets.Default <= 0 {
+		errs = append(errs, fmt.Errorf("budgets::default must be positive, got %d", cfg.Budgets.Default))
+	} else if cfg.Budgets.ResourceAttribute != "" && cfg.MaxKeys > 0 && cfg.Budgets.Default > cfg.MaxKeys {
+		errs = append(errs, fmt.Errorf("budgets::default (%d) exceeds max_keys (%d)", cfg.Budgets.Default, cfg.MaxKeys))
+	}
+	if len(cfg.Budgets.Overrides) > 0 && cfg.Budgets.ResourceAttribute == "" {
+		errs = append(errs, errors.New("budgets::overrides requires budgets::resource_attribute"))
+	}
+	for tenant, budget := range cfg.Budgets.Overrides {
+		if budget < 0 {
+			errs = append(errs, fmt.Errorf("budgets::overrides[%q] must not be negative, got %d", tenant, budget))
+		} else if cfg.MaxKeys > 0 && budget > cfg.MaxKeys {
+			errs = append(errs, fmt.Errorf("budgets::overrides[%q] (%d) exceeds max_keys (%d)", tenant, budget, cfg.MaxKeys))
+		}
+	}
+
+	if cfg.UsageMetrics.Interval <= 0 {
+		errs = append(errs, fmt.Errorf("usage_metrics::interval must be positive, got %v", cfg.UsageMetrics.Interval))
+	}
+	if cfg.UsageMetrics.MaxMetrics <= 0 {
+		errs = append(errs, fmt.Errorf("usage_metrics::max_metrics must be positive, got %d", cfg.UsageMetrics.MaxMetrics))
+	}
+
+	if cfg.DebugEndpoint != "" {
+		if _, _, err := net.SplitHostPort(cfg.DebugEndpoint); err != nil {
+			errs = append(errs, fmt.Errorf("invalid debug_endpoint %q: %v", cfg.DebugEndpoint, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateLabels reports empty label names
+func validateLabels(field string, labels []string) []error {
+	var errs []error
+	for i, label := range labels {
+		if label == "" {
+			errs = append(errs, fmt.Errorf("%s[%d] must not be empty", field, i))
+		}
+	}
+	return errs
 }
 
 // Export the plugin factory function
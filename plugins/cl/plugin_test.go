@@ -0,0 +1,180 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(cfg *Config)
+		// wantErrs holds a substring of every error Validate must report
+		wantErrs []string
+	}{
+		{name: "default", modify: func(*Config) {}},
+		{name: "max_keys", modify: func(cfg *Config) { cfg.MaxKeys = 0 }, wantErrs: []string{"max_keys must be positive"}},
+		{name: "high_score", modify: func(cfg *Config) { cfg.HighScore = 0 }, wantErrs: []string{"high_score must be in (0, 1]"}},
+		{
+			name:     "critical_score",
+			modify:   func(cfg *Config) { cfg.CriticalScore = 1.5 },
+			wantErrs: []string{"critical_score must be in (0, 1]"},
+		},
+		{
+			name:     "high_score not below critical_score",
+			modify:   func(cfg *Config) { cfg.HighScore, cfg.CriticalScore = 0.9, 0.9 },
+			wantErrs: []string{"high_score (0.9) must be less than critical_score (0.9)"},
+		},
+		{name: "mode", modify: func(cfg *Config) { cfg.Mode = "dry-run" }, wantErrs: []string{`mode must be "enforce" or "observe"`}},
+		{
+			name:     "limit_action",
+			modify:   func(cfg *Config) { cfg.LimitAction = "sample" },
+			wantErrs: []string{`limit_action must be "drop" or "overflow"`},
+		},
+		{
+			name:     "snapshot_interval",
+			modify:   func(cfg *Config) { cfg.SnapshotInterval = 0 },
+			wantErrs: []string{"snapshot_interval must be positive"},
+		},
+		{name: "series_ttl", modify: func(cfg *Config) { cfg.SeriesTTL = -time.Second }, wantErrs: []string{"series_ttl must be positive"}},
+		{
+			name: "empty labels",
+			modify: func(cfg *Config) {
+				cfg.AggregateLabels = []string{""}
+				cfg.AlwaysDropLabels = []string{"user.id", ""}
+			},
+			wantErrs: []string{"aggregate_labels[0] must not be empty", "always_drop_labels[1] must not be empty"},
+		},
+		{
+			name:     "empty protected label",
+			modify:   func(cfg *Config) { cfg.ProtectedLabels = []string{"service.name", ""} },
+			wantErrs: []string{"protected_labels[1] must not be empty"},
+		},
+		{
+			name: "protected label aggregated or dropped",
+			modify: func(cfg *Config) {
+				cfg.ProtectedLabels = []string{"k8s.pod.uid", "user.id"}
+				cfg.AlwaysDropLabels = []string{"user.id"}
+			},
+			wantErrs: []string{
+				`label "k8s.pod.uid" is both protected and in aggregate_labels`,
+				`label "user.id" is both protected and in always_drop_labels`,
+			},
+		},
+		{
+			name:     "protected_metrics",
+			modify:   func(cfg *Config) { cfg.ProtectedMetrics = []string{"regex:slo("} },
+			wantErrs: []string{`invalid metric pattern "slo("`},
+		},
+		{
+			name:     "normalize",
+			modify:   func(cfg *Config) { cfg.Normalize = []NormalizeRule{{Labels: []string{""}, Action: "lowercase"}} },
+			wantErrs: []string{"normalize[0]::labels[0] must not be empty", "normalize[0]: action must be"},
+		},
+		{
+			name: "attributes",
+			modify: func(cfg *Config) {
+				cfg.Attributes = AttributeLimitConfig{Action: "truncate"}
+			},
+			wantErrs: []string{
+				"attributes::max_values_per_key must be positive",
+				"attributes::action must be",
+				"attributes::hash_buckets must be positive",
+			},
+		},
+		{
+			name: "auto_aggregate",
+			modify: func(cfg *Config) {
+				cfg.AutoAggregate = AutoAggregateConfig{MetricBudget: -1}
+			},
+			wantErrs: []string{"auto_aggregate::metric_budget must be positive", "auto_aggregate::max_labels must be positive"},
+		},
+		{
+			name: "auto_aggregate over max_keys",
+			modify: func(cfg *Config) {
+				cfg.AutoAggregate.Enabled = true
+				cfg.AutoAggregate.MetricBudget = cfg.MaxKeys + 1
+			},
+			wantErrs: []string{"auto_aggregate::metric_budget (65537) exceeds max_keys (65536)"},
+		},
+		{name: "budgets default", modify: func(cfg *Config) { cfg.Budgets.Default = 0 }, wantErrs: []string{"budgets::default must be positive"}},
+		{
+			name: "budgets over max_keys",
+			modify: func(cfg *Config) {
+				cfg.Budgets.ResourceAttribute = "tenant.id"
+				cfg.Budgets.Default = cfg.MaxKeys + 1
+				cfg.Budgets.Overrides = map[string]int{"big": cfg.MaxKeys + 1, "negative": -1}
+			},
+			wantErrs: []string{
+				"budgets::default (65537) exceeds max_keys (65536)",
+				`budgets::overrides["big"] (65537) exceeds max_keys (65536)`,
+				`budgets::overrides["negative"] must not be negative`,
+			},
+		},
+		{
+			name:     "budgets overrides without a resource attribute",
+			modify:   func(cfg *Config) { cfg.Budgets.Overrides = map[string]int{"team-a": 10} },
+			wantErrs: []string{"budgets::overrides requires budgets::resource_attribute"},
+		},
+		{
+			name: "usage_metrics",
+			modify: func(cfg *Config) {
+				cfg.UsageMetrics = UsageMetricsConfig{}
+			},
+			wantErrs: []string{"usage_metrics::interval must be positive", "usage_metrics::max_metrics must be positive"},
+		},
+		{
+			name:     "debug_endpoint",
+			modify:   func(cfg *Config) { cfg.DebugEndpoint = "localhost" },
+			wantErrs: []string{`invalid debug_endpoint "localhost"`},
+		},
+		{
+			name: "every error is reported",
+			modify: func(cfg *Config) {
+				cfg.MaxKeys = 0
+				cfg.Mode = "dry-run"
+				cfg.SeriesTTL = 0
+				cfg.DebugEndpoint = "localhost"
+			},
+			wantErrs: []string{"max_keys", "mode", "series_ttl", "debug_endpoint"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := createDefaultConfig().(*Config)
+			tt.modify(cfg)
+
+			err := cfg.Validate()
+			if len(tt.wantErrs) == 0 {
+				if err != nil {
+					t.Fatalf("Validate() error = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Validate() error = nil, want %q", tt.wantErrs)
+			}
+
+			// Validate joins one error per problem
+			joined, ok := err.(interface{ Unwrap() []error })
+			if !ok {
+				t.Fatalf("Validate() error %T is not joined", err)
+			}
+			errs := joined.Unwrap()
+			if len(errs) != len(tt.wantErrs) {
+				t.Errorf("Validate() reported %d errors, want %d:\n%v", len(errs), len(tt.wantErrs), err)
+			}
+			for _, want := range tt.wantErrs {
+				found := false
+				for _, e := range errs {
+					found = found || strings.Contains(e.Error(), want)
+				}
+				if !found {
+					t.Errorf("Validate() error does not report %q:\n%v", want, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// regexPrefix marks an entry as a regular expression rather than a name
+const regexPrefix = "regex:"
+
+// metricMatcher matches metric names against a list of entries, each of which
+// is either an exact metric name or, when prefixed with "regex:", a regular
+// expression matching the whole name
+type metricMatcher struct {
+	names    map[string]struct{}
+	patterns []*regexp.Regexp
+}
+
+// newMetricMatcher compiles the given entries
+func newMetricMatcher(entries []string) (*metricMatcher, error) {
+	m := &metricMatcher{names: make(map[string]struct{}, len(entries))}
+	for _, entry := range entries {
+		pattern, ok := strings.CutPrefix(entry, regexPrefix)
+		if !ok {
+			m.names[entry] = struct{}{}
+			continue
+		}
+
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid metric pattern %q: %v", pattern, err)
+		}
+		m.patterns = append(m.patterns, re)
+	}
+	return m, nil
+}
+
+// matches reports whether name matches any entry
+func (m *metricMatcher) matches(name string) bool {
+	if _, ok := m.names[name]; ok {
+		return true
+	}
+	for _, re := range m.patterns {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
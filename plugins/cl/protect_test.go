@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestMetricMatcher(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+		metric  string
+		want    bool
+	}{
+		{name: "exact name", entries: []string{"http.server.duration"}, metric: "http.server.duration", want: true},
+		{name: "name dots are literal", entries: []string{"http.server.duration"}, metric: "http_server_duration", want: false},
+		{name: "name with regex characters", entries: []string{"latency(p99)"}, metric: "latency(p99)", want: true},
+		{name: "name is not a prefix", entries: []string{"slo"}, metric: "slo.availability", want: false},
+		{name: "regex", entries: []string{"regex:slo\\..*"}, metric: "slo.availability", want: true},
+		{name: "regex matches the whole name", entries: []string{"regex:slo"}, metric: "slo.availability", want: false},
+		{name: "regex entry is not a name", entries: []string{"regex:slo"}, metric: "regex:slo", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := newMetricMatcher(tt.entries)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := m.matches(tt.metric); got != tt.want {
+				t.Errorf("matches(%q) = %v, want %v", tt.metric, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetricMatcherInvalid(t *testing.T) {
+	if _, err := newMetricMatcher([]string{"latency(p99"}); err != nil {
+		t.Errorf("plain name rejected: %v", err)
+	}
+	if _, err := newMetricMatcher([]string{"regex:latency(p99"}); err == nil {
+		t.Error("invalid regex accepted")
+	}
+}
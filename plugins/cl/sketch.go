@@ -0,0 +1,72 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+const (
+	// hllPrecision is the number of hash bits used to pick a register
+	hllPrecision = 10
+	hllRegisters = 1 << hllPrecision
+
+	// maxLabelSketches bounds how many label keys get a sketch (~1 KiB each)
+	maxLabelSketches = 1024
+)
+
+// labelSketch is a HyperLogLog estimating the distinct values of one label
+type labelSketch struct {
+	registers [hllRegisters]uint8
+}
+
+// add records a label value
+func (s *labelSketch) add(value string) {
+	s.addHash(sketchHash(value))
+}
+
+// addHash records a label value hashed with sketchHash
+func (s *labelSketch) addHash(x uint64) {
+	idx := x >> (64 - hllPrecision)
+	rank := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1)) + 1)
+	if rank > s.registers[idx] {
+		s.registers[idx] = rank
+	}
+}
+
+// estimate returns the approximate number of distinct values seen
+func (s *labelSketch) estimate() float64 {
+	m := float64(hllRegisters)
+	sum := 0.0
+	zeros := 0
+	for _, r := range s.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		// Small range correction (linear counting)
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return estimate
+}
+
+// sketchHash hashes a label value for addHash
+func sketchHash(value string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(value))
+	return mix64(h.Sum64())
+}
+
+// mix64 spreads FNV output across all bits before it feeds the sketch
+func mix64(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// The series tracker is periodically snapshotted to Config.StateFile so that a
+// restarted collector does not treat every series as new. The file starts with
+// a fixed header of magic bytes, payload length and the SHA-256 of the
+// payload. A snapshot failing any check is ignored and the limiter starts
+// empty rather than refusing to start.
+
+const (
+	stateMagic      = "NRCLv3"
+	stateHeaderSize = len(stateMagic) + 8 + sha256.Size
+
+	defaultSnapshotInterval = time.Minute
+
+	// stateEntrySize is the encoded size of one tracker entry
+	stateEntrySize = 8 + 8 + 8 + 4 + 4
+)
+
+// trackerState is the part of the processor that snapshots capture
+type trackerState struct {
+	keyMap        map[uint64]seriesEntry
+	labelSketches map[string]*labelSketch
+	metricIDs     map[string]uint32
+	metricStats   []*metricStats
+	tenantIDs     map[string]uint32
+	tenantStats   []*tenantStats
+}
+
+// snapshotLoop writes a snapshot every SnapshotInterval
+func (p *cardinalityLimiterProcessor) snapshotLoop(ctx context.Context) {
+	defer p.backgroundWg.Done()
+
+	ticker := time.NewTicker(p.config.SnapshotInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := p.saveState(); err != nil {
+				p.logger.Error("Failed to snapshot cardinality limiter state", zap.Error(err))
+			}
+		}
+	}
+}
+
+// saveState atomically replaces the state file with the current tracker state
+func (p *cardinalityLimiterProcessor) saveState() error {
+	payload := p.encodeState()
+	hash := sha256.Sum256(payload)
+
+	header := make([]byte, 0, stateHeaderSize)
+	header = append(header, stateMagic...)
+	header = binary.BigEndian.AppendUint64(header, uint64(len(payload)))
+	header = append(header, hash[:]...)
+
+	if err := os.MkdirAll(filepath.Dir(p.config.StateFile), 0755); err != nil {
+		return fmt.Errorf("failed to create state directory: %v", err)
+	}
+
+	tmpPath := p.config.StateFile + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create state file: %v", err)
+	}
+	if _, err := file.Write(header); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write state header: %v", err)
+	}
+	if _, err := file.Write(payload); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write state payload: %v", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync state file: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close state file: %v", err)
+	}
+
+	if err := os.Rename(tmpPath, p.config.StateFile); err != nil {
+		return fmt.Errorf("failed to replace state file: %v", err)
+	}
+	return nil
+}
+
+// loadState replaces the tracker state with the snapshot on disk. A missing
+// file is not an error; a corrupted one leaves the tracker untouched.
+func (p *cardinalityLimiterProcessor) loadState() error {
+	data, err := os.ReadFile(p.config.StateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read state file: %v", err)
+	}
+
+	if len(data) < stateHeaderSize {
+		return errors.New("state file truncated")
+	}
+	if string(data[:len(stateMagic)]) != stateMagic {
+		return errors.New("invalid magic bytes or unsupported snapshot version")
+	}
+	payloadLen := binary.BigEndian.Uint64(data[len(stateMagic):])
+	storedHash := data[len(stateMagic)+8 : stateHeaderSize]
+	payload := data[stateHeaderSize:]
+	if uint64(len(payload)) != payloadLen {
+		return fmt.Errorf("payload length mismatch: header %d, file %d", payloadLen, len(payload))
+	}
+	if hash := sha256.Sum256(payload); !bytes.Equal(hash[:], storedHash) {
+		return errors.New("hash verification failed")
+	}
+
+	state, err := p.decodeState(payload)
+	if err != nil {
+		return err
+	}
+
+	p.statsMutex.Lock()
+	p.tracker.reset(state.keyMap)
+	p.labelSketches = state.labelSketches
+	p.metricIDs = state.metricIDs
+	p.metricStats = state.metricStats
+	p.tenantIDs = state.tenantIDs
+	p.tenantStats = state.tenantStats
+	p.keysUsed.Set(float64(len(state.keyMap)))
+	p.updateTenantGauges()
+	p.statsMutex.Unlock()
+
+	p.logger.Info("Restored cardinality limiter state",
+		zap.String("file", p.config.StateFile),
+		zap.Int("keys", len(state.keyMap)),
+		zap.Int("metrics", len(state.metricStats)),
+		zap.Int("tenants", len(state.tenantStats)),
+		zap.Int("label_sketches", len(state.labelSketches)))
+	return nil
+}
+
+// encodeState serializes the metric and tenant names, tracker entries and
+// label sketches
+func (p *cardinalityLimiterProcessor) encodeState() []byte {
+	p.statsMutex.RLock()
+	defer p.statsMutex.RUnlock()
+
+	buf := make([]byte, 0, 16+p.tracker.len()*stateEntrySize+len(p.labelSketches)*(hllRegisters+16))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(time.Now().UnixNano()))
+
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(p.metricStats)))
+	for _, stats := range p.metricStats {
+		buf = appendString(buf, stats.name)
+	}
+
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(p.tenantStats)))
+	for _, stats := range p.tenantStats {
+		buf = appendString(buf, stats.name)
+	}
+
+	// The entry count is patched in once the shards have been walked
+	countOffset := len(buf)
+	buf = binary.BigEndian.AppendUint64(buf, 0)
+	entryCount := 0
+	p.tracker.rangeShards(func(keys map[uint64]seriesEntry) bool {
+		for hash, entry := range keys {
+			buf = binary.BigEndian.AppendUint64(buf, hash)
+			buf = binary.BigEndian.AppendUint64(buf, entry.count)
+			buf = binary.BigEndian.AppendUint64(buf, uint64(entry.lastSeen))
+			buf = binary.BigEndian.AppendUint32(buf, entry.metric)
+			buf = binary.BigEndian.AppendUint32(buf, entry.tenant)
+		}
+		entryCount += len(keys)
+		return true
+	})
+	binary.BigEndian.PutUint64(buf[countOffset:], uint64(entryCount))
+
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(p.labelSketches)))
+	for key, sketch := range p.labelSketches {
+		buf = appendString(buf, key)
+		buf = append(buf, sketch.registers[:]...)
+	}
+
+	return buf
+}
+
+// decodeState parses a snapshot payload, keeping at most MaxKeys of the most
+// recently seen entries
+func (p *cardinalityLimiterProcessor) decodeState(payload []byte) (*trackerState, error) {
+	r := bytes.NewReader(payload)
+
+	var savedAt int64
+	if err := binary.Read(r, binary.BigEndian, &savedAt); err != nil {
+		return nil, fmt.Errorf("failed to read snapshot time: %v", err)
+	}
+
+	state := &trackerState{metricIDs: make(map[string]uint32)}
+	var metricCount uint32
+	if err := binary.Read(r, binary.BigEndian, &metricCount); err != nil {
+		return nil, fmt.Errorf("failed to read metric count: %v", err)
+	}
+	for i := uint32(0); i < metricCount; i++ {
+		name, err := readString(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read metric name: %v", err)
+		}
+		state.metricIDs[name] = uint32(len(state.metricStats))
+		state.metricStats = append(state.metricStats, &metricStats{name: name})
+	}
+
+	// Tenant budgets come from the current config, not the snapshot. Saved
+	// tenant ids are remapped by name, as budgets may have been turned on or
+	// off since the snapshot was taken; with budgets off, no series belongs
+	// to a tenant.
+	budgets := p.config.Budgets.ResourceAttribute != ""
+	state.tenantIDs = make(map[string]uint32)
+	internTenant := func(name string) uint32 {
+		if id, ok := state.tenantIDs[name]; ok {
+			return id
+		}
+		if len(state.tenantStats) >= maxTenants && name != otherTenant {
+			name = otherTenant
+			if id, ok := state.tenantIDs[name]; ok {
+				return id
+			}
+		}
+		id := uint32(len(state.tenantStats))
+		state.tenantIDs[name] = id
+		state.tenantStats = append(state.tenantStats, &tenantStats{name: name, budget: p.tenantBudget(name)})
+		return id
+	}
+	var tenantCount uint32
+	if err := binary.Read(r, binary.BigEndian, &tenantCount); err != nil {
+		return nil, fmt.Errorf("failed to read tenant count: %v", err)
+	}
+	if tenantCount > uint32(r.Len()/2) {
+		return nil, fmt.Errorf("tenant count %d exceeds payload", tenantCount)
+	}
+	tenantIDs := make([]uint32, tenantCount)
+	for i := range tenantIDs {
+		name, err := readString(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tenant name: %v", err)
+		}
+		if budgets {
+			tenantIDs[i] = internTenant(name)
+		}
+	}
+
+	var entryCount uint64
+	if err := binary.Read(r, binary.BigEndian, &entryCount); err != nil {
+		return nil, fmt.Errorf("failed to read entry count: %v", err)
+	}
+	if entryCount > uint64(r.Len()/stateEntrySize) {
+		return nil, fmt.Errorf("entry count %d exceeds payload", entryCount)
+	}
+
+	type restored struct {
+		hash  uint64
+		entry seriesEntry
+	}
+	entries := make([]restored, entryCount)
+	raw := make([]byte, stateEntrySize)
+	for i := range entries {
+		if _, err := io.ReadFull(r, raw); err != nil {
+			return nil, fmt.Errorf("failed to read entry: %v", err)
+		}
+		entries[i].hash = binary.BigEndian.Uint64(raw[0:8])
+		entries[i].entry.count = binary.BigEndian.Uint64(raw[8:16])
+		entries[i].entry.lastSeen = int64(binary.BigEndian.Uint64(raw[16:24]))
+		entries[i].entry.metric = binary.BigEndian.Uint32(raw[24:28])
+		if entries[i].entry.metric >= metricCount {
+			return nil, fmt.Errorf("entry references unknown metric %d", entries[i].entry.metric)
+		}
+		tenant := binary.BigEndian.Uint32(raw[28:32])
+		if tenantCount > 0 && tenant >= tenantCount {
+			return nil, fmt.Errorf("entry references unknown tenant %d", tenant)
+		}
+		switch {
+		case !budgets:
+			entries[i].entry.tenant = 0
+		case tenantCount == 0:
+			// Saved while budgets were off, so the tenant is not known
+			entries[i].entry.tenant = internTenant(unknownTenant)
+		default:
+			entries[i].entry.tenant = tenantIDs[tenant]
+		}
+	}
+
+	var sketchCount uint32
+	if err := binary.Read(r, binary.BigEndian, &sketchCount); err != nil {
+		return nil, fmt.Errorf("failed to read sketch count: %v", err)
+	}
+	state.labelSketches = make(map[string]*labelSketch, sketchCount)
+	for i := uint32(0); i < sketchCount; i++ {
+		key, err := readString(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read sketch key: %v", err)
+		}
+		sketch := &labelSketch{}
+		if _, err := io.ReadFull(r, sketch.registers[:]); err != nil {
+			return nil, fmt.Errorf("failed to read sketch registers: %v", err)
+		}
+		if len(state.labelSketches) < maxLabelSketches {
+			state.labelSketches[key] = sketch
+		}
+	}
+
+	// Keep the most recently seen entries if the budget shrank since the
+	// snapshot was taken
+	if len(entries) > p.config.MaxKeys {
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].entry.lastSeen > entries[j].entry.lastSeen
+		})
+		entries = entries[:p.config.MaxKeys]
+	}
+
+	state.keyMap = make(map[uint64]seriesEntry, p.config.MaxKeys)
+	for _, e := range entries {
+		if budgets {
+			state.tenantStats[e.entry.tenant].series.Add(1)
+		}
+		state.keyMap[e.hash] = e.entry
+		state.metricStats[e.entry.metric].series.Add(1)
+	}
+
+	return state, nil
+}
+
+// appendString appends a string prefixed with its 16-bit length, truncating
+// it if needed
+func appendString(buf []byte, s string) []byte {
+	if len(s) > math.MaxUint16 {
+		s = s[:math.MaxUint16]
+	}
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(s)))
+	return append(buf, s...)
+}
+
+// readString reads a string prefixed with its 16-bit length
+func readString(r *bytes.Reader) (string, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return "", err
+	}
+	b := make([]byte, length)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
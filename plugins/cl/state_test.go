@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"go.uber.org/zap"
+)
+
+// newStateProcessor creates a limiter persisting its state to path
+func newStateProcessor(t *testing.T, path string) *cardinalityLimiterProcessor {
+	t.Helper()
+	return newBudgetStateProcessor(t, path, "")
+}
+
+// newBudgetStateProcessor creates a limiter persisting its state to path,
+// with tenant budgets by a resource attribute unless it is empty
+func newBudgetStateProcessor(t *testing.T, path, tenantAttribute string) *cardinalityLimiterProcessor {
+	t.Helper()
+	cfg := createDefaultConfig().(*Config)
+	cfg.StateFile = path
+	cfg.Budgets.ResourceAttribute = tenantAttribute
+	p, err := newCardinalityLimiterProcessor(zap.NewNop(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// writeSnapshot feeds series through a limiter and snapshots it to path
+func writeSnapshot(t *testing.T, path string, series int) {
+	t.Helper()
+	p := newStateProcessor(t, path)
+
+	md := pmetric.NewMetrics()
+	metrics := md.ResourceMetrics().AppendEmpty().ScopeMetrics().AppendEmpty().Metrics()
+	for _, name := range []string{"http.requests", "http.latency"} {
+		metric := metrics.AppendEmpty()
+		metric.SetName(name)
+		dps := metric.SetEmptyGauge().DataPoints()
+		for i := 0; i < series; i++ {
+			dp := dps.AppendEmpty()
+			dp.SetIntValue(int64(i))
+			dp.Attributes().PutStr("host", "host-"+strconv.Itoa(i))
+		}
+	}
+	if _, err := p.processMetrics(context.Background(), md); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.saveState(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.bin")
+	writeSnapshot(t, path, 10)
+
+	p := newStateProcessor(t, path)
+	if err := p.loadState(); err != nil {
+		t.Fatal(err)
+	}
+	if got := p.tracker.len(); got != 20 {
+		t.Errorf("restored %d keys, want 20", got)
+	}
+	for _, name := range []string{"http.requests", "http.latency"} {
+		id, ok := p.metricIDs[name]
+		if !ok {
+			t.Fatalf("metric %q not restored", name)
+		}
+		if got := p.metricStats[id].series.Load(); got != 10 {
+			t.Errorf("metric %q restored %d series, want 10", name, got)
+		}
+	}
+}
+
+func TestStateCorruption(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(data []byte) []byte
+		wantErr bool
+	}{
+		{
+			name:    "intact",
+			corrupt: func(data []byte) []byte { return data },
+		},
+		{
+			name:    "missing file",
+			corrupt: func([]byte) []byte { return nil },
+		},
+		{
+			name: "flipped payload byte",
+			corrupt: func(data []byte) []byte {
+				data[len(data)-1] ^= 0xff
+				return data
+			},
+			wantErr: true,
+		},
+		{
+			name:    "truncated header",
+			corrupt: func(data []byte) []byte { return data[:stateHeaderSize-1] },
+			wantErr: true,
+		},
+		{
+			name:    "truncated payload",
+			corrupt: func(data []byte) []byte { return data[:len(data)-4] },
+			wantErr: true,
+		},
+		{
+			name:    "trailing garbage",
+			corrupt: func(data []byte) []byte { return append(data, 0) },
+			wantErr: true,
+		},
+		{
+			name: "older version",
+			corrupt: func(data []byte) []byte {
+				copy(data, "NRCLv2")
+				return data
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "state.bin")
+			writeSnapshot(t, path, 5)
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data = tt.corrupt(data); data == nil {
+				os.Remove(path)
+			} else if err := os.WriteFile(path, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			p := newStateProcessor(t, path)
+			err = p.loadState()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadState() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			// A rejected snapshot must leave the tracker empty
+			if tt.wantErr && p.tracker.len() != 0 {
+				t.Errorf("tracker holds %d keys after a failed load", p.tracker.len())
+			}
+		})
+	}
+}
+
+func TestStateBudgetChange(t *testing.T) {
+	tests := []struct {
+		name        string
+		savedWith   string // tenant attribute when saving, empty without budgets
+		loadedWith  string // tenant attribute when loading
+		wantSeries  int    // series are only told apart by tenant with budgets
+		wantTenants map[string]int64
+	}{
+		{
+			name:        "budgets unchanged",
+			savedWith:   "service.name",
+			loadedWith:  "service.name",
+			wantSeries:  5,
+			wantTenants: map[string]int64{"checkout": 3, "cart": 2},
+		},
+		{
+			name:        "budgets turned off",
+			savedWith:   "service.name",
+			wantSeries:  5,
+			wantTenants: map[string]int64{},
+		},
+		{
+			name:        "budgets turned on",
+			loadedWith:  "service.name",
+			wantSeries:  3,
+			wantTenants: map[string]int64{unknownTenant: 3},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "state.bin")
+			p := newBudgetStateProcessor(t, path, tt.savedWith)
+			md := pmetric.NewMetrics()
+			for tenant, series := range map[string]int{"checkout": 3, "cart": 2} {
+				rm := md.ResourceMetrics().AppendEmpty()
+				rm.Resource().Attributes().PutStr("service.name", tenant)
+				metric := rm.ScopeMetrics().AppendEmpty().Metrics().AppendEmpty()
+				metric.SetName("http.requests")
+				dps := metric.SetEmptyGauge().DataPoints()
+				for i := 0; i < series; i++ {
+					dp := dps.AppendEmpty()
+					dp.Attributes().PutStr("host", "host-"+strconv.Itoa(i))
+				}
+			}
+			if _, err := p.processMetrics(context.Background(), md); err != nil {
+				t.Fatal(err)
+			}
+			if err := p.saveState(); err != nil {
+				t.Fatal(err)
+			}
+
+			p = newBudgetStateProcessor(t, path, tt.loadedWith)
+			if err := p.loadState(); err != nil {
+				t.Fatal(err)
+			}
+			tenants := make(map[string]int64)
+			for _, stats := range p.tenantStats {
+				if series := stats.series.Load(); series != 0 {
+					tenants[stats.name] = series
+				}
+			}
+			if fmt.Sprint(tenants) != fmt.Sprint(tt.wantTenants) {
+				t.Errorf("restored tenant series %v, want %v", tenants, tt.wantTenants)
+			}
+
+			// Expiring every series must bring each tenant back to zero
+			p.config.SeriesTTL = -time.Hour
+			if expired := p.expireKeys(); expired != tt.wantSeries {
+				t.Fatalf("expired %d keys, want %d", expired, tt.wantSeries)
+			}
+			for _, stats := range p.tenantStats {
+				if series := stats.series.Load(); series != 0 {
+					t.Errorf("tenant %q holds %d series after expiry", stats.name, series)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"hash/fnv"
+	"sync/atomic"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// BudgetConfig scopes series budgets to tenants identified by a resource
+// attribute, so one noisy tenant cannot use up everyone else's budget
+type BudgetConfig struct {
+	// ResourceAttribute identifies the tenant, e.g. service.name or
+	// k8s.namespace.name. Budgets are disabled when empty.
+	ResourceAttribute string `mapstructure:"resource_attribute"`
+
+	// Default is the series budget of tenants without an override
+	Default int `mapstructure:"default"`
+
+	// Overrides sets the series budget of specific tenants
+	Overrides map[string]int `mapstructure:"overrides"`
+}
+
+const (
+	defaultTenantBudget = 8192
+
+	// unknownTenant owns series whose resource lacks the tenant attribute
+	unknownTenant = "unknown"
+
+	// otherTenant absorbs tenants beyond maxTenants
+	otherTenant = "other"
+	maxTenants  = 1024
+)
+
+// tenantStats is the budget and usage of one tenant. Series is updated
+// atomically, dropped and wouldDrop under statsMutex.
+type tenantStats struct {
+	name      string
+	budget    int
+	series    atomic.Int64
+	dropped   uint64
+	wouldDrop uint64
+}
+
+// metrics
+var (
+	tenantKeysUsedMetric = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cl_tenant_keys_used",
+			Help: "Current number of unique keys tracked per tenant by the cardinality limiter",
+		},
+		[]string{"tenant"},
+	)
+
+	tenantDroppedSamplesMetric = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cl_tenant_dropped_samples_total",
+			Help: "Total number of samples dropped per tenant by the cardinality limiter",
+		},
+		[]string{"tenant"},
+	)
+)
+
+// tenantRef identifies the tenant a batch of datapoints belongs to. Stats is
+// nil when budgets are disabled.
+type tenantRef struct {
+	id    uint32
+	name  string
+	hash  uint64
+	stats *tenantStats
+}
+
+// resolveTenant determines the tenant of a resource
+func (p *cardinalityLimiterProcessor) resolveTenant(resource pcommon.Resource) tenantRef {
+	if p.config.Budgets.ResourceAttribute == "" {
+		return tenantRef{}
+	}
+
+	name := unknownTenant
+	if v, ok := resource.Attributes().Get(p.config.Budgets.ResourceAttribute); ok {
+		name = v.AsString()
+	}
+
+	p.statsMutex.RLock()
+	id, ok := p.tenantIDs[name]
+	p.statsMutex.RUnlock()
+	if !ok {
+		p.statsMutex.Lock()
+		id = p.internTenant(name)
+		p.statsMutex.Unlock()
+	}
+
+	p.statsMutex.RLock()
+	stats := p.tenantStats[id]
+	p.statsMutex.RUnlock()
+
+	h := fnv.New64a()
+	h.Write([]byte(stats.name))
+	return tenantRef{id: id, name: stats.name, hash: h.Sum64(), stats: stats}
+}
+
+// internTenant returns the stats index of a tenant, adding it if needed.
+// Callers must hold statsMutex.
+func (p *cardinalityLimiterProcessor) internTenant(name string) uint32 {
+	if id, ok := p.tenantIDs[name]; ok {
+		return id
+	}
+	if len(p.tenantStats) >= maxTenants && name != otherTenant {
+		return p.internTenant(otherTenant)
+	}
+
+	id := uint32(len(p.tenantStats))
+	p.tenantIDs[name] = id
+	p.tenantStats = append(p.tenantStats, &tenantStats{name: name, budget: p.tenantBudget(name)})
+	return id
+}
+
+// tenantBudget returns the configured series budget of a tenant
+func (p *cardinalityLimiterProcessor) tenantBudget(name string) int {
+	if budget, ok := p.config.Budgets.Overrides[name]; ok {
+		return budget
+	}
+	return p.config.Budgets.Default
+}
+
+// admit counts a new series against the tenant's budget, unless the budget
+// is full
+func (s *tenantStats) admit() bool {
+	for {
+		series := s.series.Load()
+		if series >= int64(s.budget) {
+			return false
+		}
+		if s.series.CompareAndSwap(series, series+1) {
+			return true
+		}
+	}
+}
+
+// updateTenantGauges publishes per-tenant usage. Callers must hold
+// statsMutex.
+func (p *cardinalityLimiterProcessor) updateTenantGauges() {
+	if p.config.Budgets.ResourceAttribute == "" {
+		return
+	}
+	for _, stats := range p.tenantStats {
+		p.tenantKeysUsed.WithLabelValues(stats.name).Set(float64(stats.series.Load()))
+	}
+}
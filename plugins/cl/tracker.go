@@ -0,0 +1,236 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// The series tracker is split into shards, each with its own lock, so that
+// concurrent pipelines only contend when they touch the same shard. Per-metric
+// and per-tenant statistics are accumulated per batch in a metricBatch and
+// applied under statsMutex once per metric per batch. Series counts are
+// atomic, so the hot path never takes statsMutex while holding a shard lock.
+
+const (
+	trackerShardBits = 6
+	trackerShards    = 1 << trackerShardBits
+)
+
+// trackerShard holds the keys whose top bits select it
+type trackerShard struct {
+	mutex sync.Mutex
+	keys  map[uint64]seriesEntry
+
+	// Keep shards on separate cache lines
+	_ [40]byte
+}
+
+// seriesTracker is the sharded set of tracked keys
+type seriesTracker struct {
+	shards [trackerShards]trackerShard
+	size   atomic.Int64
+}
+
+func newSeriesTracker(capacity int) *seriesTracker {
+	t := &seriesTracker{}
+	for i := range t.shards {
+		t.shards[i].keys = make(map[uint64]seriesEntry, capacity/trackerShards)
+	}
+	return t
+}
+
+// shard returns the shard owning a key. Keys are multiplied by the FNV prime,
+// so their top bits are well mixed.
+func (t *seriesTracker) shard(key uint64) *trackerShard {
+	return &t.shards[key>>(64-trackerShardBits)]
+}
+
+// len returns the number of tracked keys
+func (t *seriesTracker) len() int {
+	return int(t.size.Load())
+}
+
+// rangeShards calls fn for every shard with the shard's lock held, stopping
+// early if fn returns false
+func (t *seriesTracker) rangeShards(fn func(keys map[uint64]seriesEntry) bool) {
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.mutex.Lock()
+		more := fn(s.keys)
+		s.mutex.Unlock()
+		if !more {
+			return
+		}
+	}
+}
+
+// removeIf deletes every key for which fn returns true and returns the
+// removed entries
+func (t *seriesTracker) removeIf(fn func(seriesEntry) bool) []seriesEntry {
+	var removed []seriesEntry
+	t.rangeShards(func(keys map[uint64]seriesEntry) bool {
+		for key, entry := range keys {
+			if fn(entry) {
+				delete(keys, key)
+				removed = append(removed, entry)
+			}
+		}
+		return true
+	})
+	t.size.Add(-int64(len(removed)))
+	return removed
+}
+
+// evict removes keys other than keep until no more than maxKeys are tracked
+// and returns the removed entries. It starts with keep's shard and takes one
+// shard lock at a time, so concurrent inserts only overshoot maxKeys until
+// they evict.
+func (t *seriesTracker) evict(maxKeys int, keep uint64) []seriesEntry {
+	var evicted []seriesEntry
+	first := int(keep >> (64 - trackerShardBits))
+	for i := 0; i < trackerShards && t.len() > maxKeys; i++ {
+		s := &t.shards[(first+i)%trackerShards]
+		s.mutex.Lock()
+		for key, entry := range s.keys {
+			if key == keep {
+				continue
+			}
+			// Claim the removal before deleting, so concurrent evictions
+			// never take the tracker below maxKeys
+			n := t.size.Load()
+			if n <= int64(maxKeys) {
+				break
+			}
+			if !t.size.CompareAndSwap(n, n-1) {
+				continue
+			}
+			delete(s.keys, key)
+			evicted = append(evicted, entry)
+		}
+		s.mutex.Unlock()
+	}
+	return evicted
+}
+
+// reset replaces all tracked keys
+func (t *seriesTracker) reset(keys map[uint64]seriesEntry) {
+	var shardKeys [trackerShards]map[uint64]seriesEntry
+	for i := range shardKeys {
+		shardKeys[i] = make(map[uint64]seriesEntry, len(keys)/trackerShards)
+	}
+	for key, entry := range keys {
+		shardKeys[key>>(64-trackerShardBits)][key] = entry
+	}
+
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.mutex.Lock()
+		s.keys = shardKeys[i]
+		s.mutex.Unlock()
+	}
+	t.size.Store(int64(len(keys)))
+}
+
+// labelValue is one label value observed in a batch, hashed for the sketches
+type labelValue struct {
+	label string
+	hash  uint64
+}
+
+// metricBatch accumulates the activity of one metric in one batch
+type metricBatch struct {
+	lastScore  float64
+	maxScore   float64
+	scored     bool
+	aggregated uint64
+	overflowed uint64
+	dropped    uint64
+	observed   [decisionDrop + 1]uint64
+
+	// budgetDropped is the part of dropped that was over a tenant budget
+	budgetDropped uint64
+
+	// Label values of every datapoint and of datapoints creating a series
+	labels []labelValue
+	growth []labelValue
+}
+
+var metricBatchPool = sync.Pool{
+	New: func() any { return &metricBatch{} },
+}
+
+func newMetricBatch() *metricBatch {
+	b := metricBatchPool.Get().(*metricBatch)
+	*b = metricBatch{labels: b.labels[:0], growth: b.growth[:0]}
+	return b
+}
+
+// record accounts for the decision taken on one datapoint
+func (b *metricBatch) record(score float64, decision limitDecision) {
+	b.lastScore = score
+	if !b.scored || score > b.maxScore {
+		b.maxScore = score
+	}
+	b.scored = true
+	switch decision {
+	case decisionAggregate:
+		b.aggregated++
+	case decisionOverflow:
+		b.overflowed++
+	case decisionDrop:
+		b.dropped++
+	}
+}
+
+// trackKey records a sighting of a key, admitting it against the tenant's
+// budget if it is new and checkBudget is set. It reports whether the key was
+// admitted and whether it is new.
+func (p *cardinalityLimiterProcessor) trackKey(mc metricContext, key uint64, checkBudget bool) (admitted, created bool) {
+	s := p.tracker.shard(key)
+	s.mutex.Lock()
+	entry, exists := s.keys[key]
+	if !exists {
+		if checkBudget && !mc.tenant.stats.admit() {
+			s.mutex.Unlock()
+			return false, false
+		}
+		if !checkBudget && mc.tenant.stats != nil {
+			mc.tenant.stats.series.Add(1)
+		}
+		entry.metric = mc.id
+		entry.tenant = mc.tenant.id
+		mc.stats.series.Add(1)
+	}
+	entry.count++
+	entry.lastSeen = mc.now.UnixNano()
+	s.keys[key] = entry
+
+	over := !exists && int(p.tracker.size.Add(1)) > p.config.MaxKeys
+	s.mutex.Unlock()
+
+	if over {
+		// For now, simple approach: remove random keys, from this shard
+		// first, until the tracker is back within MaxKeys
+		// TODO: Implement LRU or heat-weighted eviction
+		p.releaseSeries(p.tracker.evict(p.config.MaxKeys, key))
+	}
+	return true, !exists
+}
+
+// releaseSeries updates series counts for keys removed from the tracker
+func (p *cardinalityLimiterProcessor) releaseSeries(entries []seriesEntry) {
+	if len(entries) == 0 {
+		return
+	}
+
+	p.statsMutex.RLock()
+	defer p.statsMutex.RUnlock()
+	for _, entry := range entries {
+		if int(entry.metric) < len(p.metricStats) {
+			p.metricStats[entry.metric].series.Add(-1)
+		}
+		if int(entry.tenant) < len(p.tenantStats) {
+			p.tenantStats[entry.tenant].series.Add(-1)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"go.uber.org/zap"
+)
+
+// The target is 1M datapoints/s during a storm. Run with
+//
+//	go test -run '^$' -bench . -cpu 1,4,8 ./plugins/cl
+//
+// and compare the reported datapoints/s. On a single CPU this measures about
+// 650k-720k datapoints/s, short of the target; whether more cores reach it
+// has not been measured.
+
+const benchBatchSize = 1000
+
+// benchBatches builds batches of gauge datapoints where every datapoint is a
+// new series, as during a cardinality storm
+func benchBatches(n int) []pmetric.Metrics {
+	batches := make([]pmetric.Metrics, n)
+	for b := range batches {
+		md := pmetric.NewMetrics()
+		rm := md.ResourceMetrics().AppendEmpty()
+		rm.Resource().Attributes().PutStr("service.name", "storm-generator")
+		metrics := rm.ScopeMetrics().AppendEmpty().Metrics()
+		for m := 0; m < 10; m++ {
+			metric := metrics.AppendEmpty()
+			metric.SetName("storm.metric." + strconv.Itoa(m))
+			dps := metric.SetEmptyGauge().DataPoints()
+			for i := 0; i < benchBatchSize/10; i++ {
+				dp := dps.AppendEmpty()
+				dp.SetDoubleValue(float64(i))
+				dp.Attributes().PutStr("http.route", "/api/v1/items")
+				dp.Attributes().PutStr("host", "host-"+strconv.Itoa(i%16))
+				dp.Attributes().PutStr("request.id", strconv.Itoa(b*benchBatchSize+m*100+i))
+			}
+		}
+		batches[b] = md
+	}
+	return batches
+}
+
+func newBenchProcessor(b *testing.B) *cardinalityLimiterProcessor {
+	cfg := createDefaultConfig().(*Config)
+	cfg.MaxKeys = 1 << 20
+	p, err := newCardinalityLimiterProcessor(zap.NewNop(), cfg)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return p
+}
+
+// reportThroughput reports datapoints per second of wall time
+func reportThroughput(b *testing.B) {
+	b.ReportMetric(float64(b.N)*benchBatchSize/b.Elapsed().Seconds(), "datapoints/s")
+}
+
+func BenchmarkProcessMetrics(b *testing.B) {
+	p := newBenchProcessor(b)
+	batches := benchBatches(64)
+	md := pmetric.NewMetrics()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		batches[i%len(batches)].CopyTo(md)
+		b.StartTimer()
+		if _, err := p.processMetrics(context.Background(), md); err != nil {
+			b.Fatal(err)
+		}
+	}
+	reportThroughput(b)
+}
+
+func BenchmarkProcessMetricsParallel(b *testing.B) {
+	p := newBenchProcessor(b)
+	batches := benchBatches(64)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		md := pmetric.NewMetrics()
+		i := 0
+		for pb.Next() {
+			// The copy is part of the measurement here, as with concurrent
+			// receivers each batch is decoded before it is processed
+			batches[i%len(batches)].CopyTo(md)
+			if _, err := p.processMetrics(context.Background(), md); err != nil {
+				b.Fatal(err)
+			}
+			i++
+		}
+	})
+	reportThroughput(b)
+}
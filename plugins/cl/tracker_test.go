@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestTrackKeyMaxKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		// shards holds the shard of every key inserted, in order
+		shards []uint64
+	}{
+		{name: "same shard", shards: []uint64{0, 0, 0, 0, 0}},
+		{name: "one key per shard", shards: []uint64{0, 1, 2, 3, 4}},
+		{name: "new shard after a full one", shards: []uint64{0, 0, 0, 5, 6}},
+	}
+
+	const maxKeys = 2
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := createDefaultConfig().(*Config)
+			cfg.MaxKeys = maxKeys
+			p, err := newCardinalityLimiterProcessor(zap.NewNop(), cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mc := p.newMetricContext("requests", tenantRef{})
+
+			for i, shard := range tt.shards {
+				key := shard<<(64-trackerShardBits) | uint64(i)
+				if admitted, created := p.trackKey(mc, key, false); !admitted || !created {
+					t.Fatalf("key %d admitted = %v, created = %v", i, admitted, created)
+				}
+				held := 0
+				p.tracker.rangeShards(func(keys map[uint64]seriesEntry) bool {
+					held += len(keys)
+					return true
+				})
+				if want := min(i+1, maxKeys); held != want || p.tracker.len() != want {
+					t.Fatalf("after key %d tracker holds %d keys, counts %d, want %d", i, held, p.tracker.len(), want)
+				}
+				if series := mc.stats.series.Load(); series != int64(held) {
+					t.Fatalf("after key %d metric counts %d series, want %d", i, series, held)
+				}
+				s := p.tracker.shard(key)
+				s.mutex.Lock()
+				_, kept := s.keys[key]
+				s.mutex.Unlock()
+				if !kept {
+					t.Fatalf("key %d evicted by its own insert", i)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"go.uber.org/zap"
+)
+
+// UsageMetricsConfig makes the processor emit its own usage as OTLP metrics
+// into the metrics pipeline it is part of, next to the data they describe
+type UsageMetricsConfig struct {
+	Enabled  bool          `mapstructure:"enabled"`
+	Interval time.Duration `mapstructure:"interval"`
+
+	// MaxMetrics bounds how many metrics, by series, get per-metric usage.
+	// Metrics with drops always get it, even past the bound.
+	MaxMetrics int `mapstructure:"max_metrics"`
+}
+
+const (
+	defaultUsageInterval   = time.Minute
+	defaultUsageMaxMetrics = 100
+
+	usageScopeName = "github.com/nr-labs/nrdot-mvp/plugins/cl"
+)
+
+// usageLoop emits usage metrics every UsageMetrics.Interval
+func (p *cardinalityLimiterProcessor) usageLoop(ctx context.Context) {
+	defer p.backgroundWg.Done()
+
+	ticker := time.NewTicker(p.config.UsageMetrics.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := p.usageConsumer.ConsumeMetrics(ctx, p.buildUsageMetrics(now)); err != nil {
+				p.logger.Warn("Failed to emit cardinality limiter usage metrics", zap.Error(err))
+			}
+		}
+	}
+}
+
+// buildUsageMetrics reports series per metric, drops (or would-be drops in
+// observe mode) per metric and reason, and key and tenant budget utilization
+func (p *cardinalityLimiterProcessor) buildUsageMetrics(now time.Time) pmetric.Metrics {
+	md := pmetric.NewMetrics()
+	rm := md.ResourceMetrics().AppendEmpty()
+	rm.Resource().Attributes().PutStr("otelcol.component.id", p.id.String())
+	rm.Resource().Attributes().PutStr("cardinalitylimiter.mode", p.config.Mode)
+	sm := rm.ScopeMetrics().AppendEmpty()
+	sm.Scope().SetName(usageScopeName)
+	metrics := sm.Metrics()
+
+	ts := pcommon.NewTimestampFromTime(now)
+	start := pcommon.NewTimestampFromTime(p.startTime)
+
+	keys := metrics.AppendEmpty()
+	keys.SetName("cardinalitylimiter.keys")
+	keys.SetDescription("Keys tracked by the cardinality limiter")
+	keys.SetUnit("{series}")
+	dp := keys.SetEmptyGauge().DataPoints().AppendEmpty()
+	dp.SetTimestamp(ts)
+	dp.SetIntValue(int64(p.tracker.len()))
+
+	utilization := metrics.AppendEmpty()
+	utilization.SetName("cardinalitylimiter.utilization")
+	utilization.SetDescription("Fraction of the key budget in use, overall and per tenant")
+	utilization.SetUnit("1")
+	utilizationDps := utilization.SetEmptyGauge().DataPoints()
+	dp = utilizationDps.AppendEmpty()
+	dp.SetTimestamp(ts)
+	dp.SetDoubleValue(float64(p.tracker.len()) / float64(p.config.MaxKeys))
+
+	series := metrics.AppendEmpty()
+	series.SetName("cardinalitylimiter.metric.series")
+	series.SetDescription("Series tracked per metric")
+	series.SetUnit("{series}")
+	seriesDps := series.SetEmptyGauge().DataPoints()
+
+	// Observe mode drops nothing, so it reports what it would have dropped
+	// under a separate name
+	dropped := metrics.AppendEmpty()
+	if p.observing() {
+		dropped.SetName("cardinalitylimiter.metric.would_drop")
+		dropped.SetDescription("Datapoints observe mode would have dropped per metric and reason")
+	} else {
+		dropped.SetName("cardinalitylimiter.metric.dropped")
+		dropped.SetDescription("Datapoints dropped per metric and reason")
+	}
+	dropped.SetUnit("{datapoints}")
+	droppedSum := dropped.SetEmptySum()
+	droppedSum.SetIsMonotonic(true)
+	droppedSum.SetAggregationTemporality(pmetric.AggregationTemporalityCumulative)
+	droppedDps := droppedSum.DataPoints()
+
+	type metricUsage struct {
+		name          string
+		series        int64
+		dropped       uint64
+		budgetDropped uint64
+	}
+
+	p.statsMutex.RLock()
+	usage := make([]metricUsage, 0, len(p.metricStats))
+	for _, stats := range p.metricStats {
+		u := metricUsage{
+			name:          stats.name,
+			series:        stats.series.Load(),
+			dropped:       stats.dropped,
+			budgetDropped: stats.budgetDropped,
+		}
+		if p.observing() {
+			u.dropped, u.budgetDropped = stats.wouldDrop, stats.budgetWouldDrop
+		}
+		usage = append(usage, u)
+	}
+	if p.config.Budgets.ResourceAttribute != "" {
+		for _, stats := range p.tenantStats {
+			dp := utilizationDps.AppendEmpty()
+			dp.SetTimestamp(ts)
+			dp.Attributes().PutStr("tenant", stats.name)
+			if stats.budget > 0 {
+				dp.SetDoubleValue(float64(stats.series.Load()) / float64(stats.budget))
+			}
+		}
+	}
+	p.statsMutex.RUnlock()
+
+	// Metrics with drops are the ones being limited, so they are always
+	// reported; MaxMetrics bounds the others, by series
+	sort.Slice(usage, func(i, j int) bool {
+		if (usage[i].dropped > 0) != (usage[j].dropped > 0) {
+			return usage[i].dropped > 0
+		}
+		return usage[i].series > usage[j].series
+	})
+	limit := p.config.UsageMetrics.MaxMetrics
+	for limit < len(usage) && usage[limit].dropped > 0 {
+		limit++
+	}
+	if len(usage) > limit {
+		usage = usage[:limit]
+	}
+
+	for _, u := range usage {
+		dp := seriesDps.AppendEmpty()
+		dp.SetTimestamp(ts)
+		dp.Attributes().PutStr("metric.name", u.name)
+		dp.SetIntValue(u.series)
+
+		for _, reason := range []string{reasonScore, reasonBudget} {
+			count := u.budgetDropped
+			if reason == reasonScore {
+				count = u.dropped - u.budgetDropped
+			}
+			dp := droppedDps.AppendEmpty()
+			dp.SetStartTimestamp(start)
+			dp.SetTimestamp(ts)
+			dp.Attributes().PutStr("metric.name", u.name)
+			dp.Attributes().PutStr("reason", reason)
+			dp.SetIntValue(int64(count))
+		}
+	}
+
+	return md
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestUsageMetricsMaxMetrics(t *testing.T) {
+	type metric struct {
+		name    string
+		series  int64
+		dropped uint64
+	}
+	tests := []struct {
+		name       string
+		maxMetrics int
+		metrics    []metric
+		want       []string
+	}{
+		{
+			name:       "bounded by series",
+			maxMetrics: 1,
+			metrics:    []metric{{name: "a", series: 10}, {name: "b", series: 20}},
+			want:       []string{"b"},
+		},
+		{
+			name:       "metrics with drops past the bound",
+			maxMetrics: 1,
+			metrics: []metric{
+				{name: "a", series: 10},
+				{name: "b", series: 20},
+				{name: "limited", series: 1, dropped: 500},
+				{name: "throttled", series: 2, dropped: 3},
+			},
+			want: []string{"limited", "throttled"},
+		},
+		{
+			name:       "metrics with drops first, then by series",
+			maxMetrics: 3,
+			metrics: []metric{
+				{name: "a", series: 10},
+				{name: "b", series: 20},
+				{name: "c", series: 5},
+				{name: "limited", series: 1, dropped: 500},
+			},
+			want: []string{"a", "b", "limited"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := createDefaultConfig().(*Config)
+			cfg.UsageMetrics.MaxMetrics = tt.maxMetrics
+			p, err := newCardinalityLimiterProcessor(zap.NewNop(), cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, m := range tt.metrics {
+				stats := p.metricStats[p.internMetric(m.name)]
+				stats.series.Store(m.series)
+				stats.dropped = m.dropped
+			}
+
+			md := p.buildUsageMetrics(time.Now())
+			metrics := md.ResourceMetrics().At(0).ScopeMetrics().At(0).Metrics()
+			var got []string
+			for i := 0; i < metrics.Len(); i++ {
+				if metrics.At(i).Name() != "cardinalitylimiter.metric.series" {
+					continue
+				}
+				dps := metrics.At(i).Gauge().DataPoints()
+				for j := 0; j < dps.Len(); j++ {
+					name, _ := dps.At(j).Attributes().Get("metric.name")
+					got = append(got, name.Str())
+				}
+			}
+			sort.Strings(got)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("usage reported for %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,406 @@
+package dlq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// The DLQ keeps the segments in its directory within max_total_bytes. The
+// bytes every segment holds, per priority class, are tracked in memory from
+// Start on, so a write can tell whether it fits without listing the
+// directory. When it does not, the overflow policy decides:
+//
+//   - reject fails the write with ErrFull
+//   - drop_oldest deletes the oldest segments until the write fits
+//   - drop_lowest_priority drops the lowest priority items, oldest segment
+//     first, never dropping items of a higher priority than the one being
+//     written. A segment holding only those items is deleted. When every
+//     segment holding them holds others too, the oldest is rewritten without
+//     them in the background, and the write is rejected with ErrFull
+//     meanwhile, so writes never wait on a rewrite.
+//
+// Neither the segment being written nor the one replay is reading is ever
+// dropped or rewritten, as that would move the items under the cursor.
+// Storage client segments count toward the limit but are never dropped.
+
+const (
+	defaultMaxTotalBytes = 16 * 1024 * 1024 * 1024 // 16 GiB
+
+	overflowReject             = "reject"
+	overflowDropOldest         = "drop_oldest"
+	overflowDropLowestPriority = "drop_lowest_priority"
+
+	defaultOverflowPolicy = overflowDropOldest
+)
+
+// ErrFull is returned when an item does not fit in the DLQ and the overflow
+// policy cannot make room for it
+var ErrFull = errors.New("dlq is full")
+
+// segmentUsage is what a segment holds on disk
+type segmentUsage struct {
+	size     int64
+	items    int64
+	priority map[uint8]int64 // item bytes per priority class
+
+	// When the oldest and newest items were stored, in Unix nanoseconds
+	oldest int64
+	newest int64
+}
+
+// lowestPriority returns the lowest priority class of the segment's items
+func (u *segmentUsage) lowestPriority() (uint8, bool) {
+	var lowest uint8
+	found := false
+	for priority, bytes := range u.priority {
+		if bytes > 0 && (!found || priority < lowest) {
+			lowest = priority
+			found = true
+		}
+	}
+	return lowest, found
+}
+
+// scanUsage rebuilds the usage of every segment in the directory
+func (fs *FileStorageExtension) scanUsage() error {
+	segments, err := fs.listSegments()
+	if err != nil {
+		return err
+	}
+
+	// Drop indexes left behind by segments removed in a crash
+	indexes, _ := filepath.Glob(filepath.Join(fs.config.Directory, "*.dlq"+indexSuffix))
+	for _, path := range indexes {
+		if _, err := os.Stat(strings.TrimSuffix(path, indexSuffix)); os.IsNotExist(err) {
+			os.Remove(path)
+		}
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	fs.usage = make(map[string]*segmentUsage, len(segments))
+	fs.totalBytes = 0
+	for _, segmentPath := range segments {
+		fs.trackSegment(segmentPath)
+	}
+	fs.storageBytes.Store(clientSegmentBytes(filepath.Join(fs.config.Directory, clientsDirectory)))
+	return nil
+}
+
+// clientSegmentBytes sums the size of the storage client segments under dir
+func clientSegmentBytes(dir string) int64 {
+	paths, _ := filepath.Glob(filepath.Join(dir, "*", "*.dlq"))
+	var total int64
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			total += info.Size()
+		}
+	}
+	return total
+}
+
+// usedBytes returns the bytes counted against max_total_bytes. Callers must
+// hold the mutex.
+func (fs *FileStorageExtension) usedBytes() int64 {
+	return fs.totalBytes + fs.storageBytes.Load()
+}
+
+// trackSegment reads the usage of a finalized segment from its index. Callers
+// must hold the mutex.
+func (fs *FileStorageExtension) trackSegment(path string) {
+	fs.forgetSegment(path)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		fs.logger.Warn("Failed to stat segment",
+			zap.String("segment", path),
+			zap.Error(err))
+		return
+	}
+
+	ix, err := fs.indexSegment(path, info.Size())
+	if err != nil {
+		fs.logger.Warn("Failed to index segment",
+			zap.String("segment", path),
+			zap.Error(err))
+		if ix == nil {
+			return
+		}
+	}
+
+	usage := indexUsage(ix, info)
+	fs.usage[path] = usage
+	fs.totalBytes += usage.size
+}
+
+// forgetSegment stops tracking a segment that was removed. Callers must hold
+// the mutex.
+func (fs *FileStorageExtension) forgetSegment(path string) {
+	if usage, ok := fs.usage[path]; ok {
+		fs.totalBytes -= usage.size
+		delete(fs.usage, path)
+	}
+}
+
+// trackWrite accounts for an item appended to a segment. Callers must hold
+// the mutex.
+func (fs *FileStorageExtension) trackWrite(path string, rec record, written int64) {
+	usage, ok := fs.usage[path]
+	if !ok {
+		usage = &segmentUsage{priority: make(map[uint8]int64)}
+		fs.usage[path] = usage
+	}
+	usage.size += written
+	usage.items++
+	usage.priority[rec.priority] += written
+	if usage.oldest == 0 || rec.storedAt < usage.oldest {
+		usage.oldest = rec.storedAt
+	}
+	if rec.storedAt > usage.newest {
+		usage.newest = rec.storedAt
+	}
+	fs.totalBytes += written
+}
+
+// indexSegment returns the index of a finalized segment, indexing it again
+// if it has none or it is stale
+func (fs *FileStorageExtension) indexSegment(path string, size int64) (*segmentIndex, error) {
+	if ix, err := loadIndex(path, size); err == nil {
+		return ix, nil
+	}
+
+	ix, err := scanIndex(path)
+	if err != nil {
+		return ix, err
+	}
+	fs.writeSegmentIndex(path, ix)
+	return ix, nil
+}
+
+// indexUsage sums up what an index says a segment holds. Segments without
+// item timestamps are aged by their last write.
+func indexUsage(ix *segmentIndex, info os.FileInfo) *segmentUsage {
+	usage := &segmentUsage{
+		size:     info.Size(),
+		items:    ix.Items,
+		priority: make(map[uint8]int64),
+		oldest:   ix.MinStoredAt,
+		newest:   ix.MaxStoredAt,
+	}
+	for _, entry := range ix.Records {
+		usage.priority[entry.Priority] += entry.Size
+	}
+	if usage.newest == 0 {
+		usage.oldest = info.ModTime().UnixNano()
+		usage.newest = usage.oldest
+	}
+	return usage
+}
+
+// removeSegment deletes a segment along with its index and stops tracking
+// it. Callers must hold the mutex.
+func (fs *FileStorageExtension) removeSegment(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	removeIndex(path)
+	fs.forgetSegment(path)
+	return nil
+}
+
+// makeRoom applies the overflow policy until an item of a size and priority
+// fits. Callers must hold the mutex.
+func (fs *FileStorageExtension) makeRoom(size int64, priority uint8) error {
+	for fs.usedBytes()+size > fs.config.MaxTotalBytes {
+		var err error
+		switch fs.config.OverflowPolicy {
+		case overflowDropOldest:
+			err = fs.dropOldestSegment()
+		case overflowDropLowestPriority:
+			err = fs.dropLowestPriority(priority)
+		default:
+			err = ErrFull
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropOldestSegment deletes the oldest segment other than the one being
+// written and the one replay is reading. Callers must hold the mutex.
+func (fs *FileStorageExtension) dropOldestSegment() error {
+	for _, path := range fs.trackedSegments() {
+		if fs.isCurrentSegment(path) || fs.isReplaying(path) {
+			continue
+		}
+
+		size := fs.usage[path].size
+		if err := fs.removeSegment(path); err != nil {
+			return fmt.Errorf("failed to drop segment: %v", err)
+		}
+		fs.dequeueReplay(path)
+
+		fs.droppedBytes.WithLabelValues(overflowDropOldest).Add(float64(size))
+		fs.logger.Warn("Dropped oldest segment to make room",
+			zap.String("segment", path),
+			zap.Int64("bytes", size))
+		return nil
+	}
+	return ErrFull
+}
+
+// priorityCompaction asks the compaction loop to rewrite a segment without
+// the items of a priority class
+type priorityCompaction struct {
+	path     string
+	priority uint8
+	usage    *segmentUsage // the usage tracked when it was asked for
+}
+
+// dropLowestPriority removes the lowest priority items present, up to a
+// priority. The oldest segment holding nothing else is deleted; rewriting a
+// segment holding others too takes too long to hold the mutex for, so when
+// there is none, the oldest segment holding them is left to the compaction
+// loop and ErrFull is returned. Callers must hold the mutex.
+func (fs *FileStorageExtension) dropLowestPriority(limit uint8) error {
+	var candidates []string
+	var lowest uint8
+	for _, path := range fs.trackedSegments() {
+		if fs.isCurrentSegment(path) || fs.isReplaying(path) {
+			continue
+		}
+		priority, ok := fs.usage[path].lowestPriority()
+		if !ok || priority > limit {
+			continue
+		}
+		if len(candidates) == 0 || priority < lowest {
+			candidates = candidates[:0]
+			lowest = priority
+		}
+		if priority == lowest {
+			candidates = append(candidates, path)
+		}
+	}
+	if len(candidates) == 0 {
+		return ErrFull
+	}
+
+	var target string
+	for _, path := range candidates {
+		usage := fs.usage[path]
+		if usage.priority[lowest] == usage.size-int64(headerSize) {
+			target = path
+			break
+		}
+	}
+	if target == "" {
+		select {
+		case fs.compactions <- priorityCompaction{path: candidates[0], priority: lowest, usage: fs.usage[candidates[0]]}:
+		default:
+			// A compaction is already pending
+		}
+		return ErrFull
+	}
+
+	dropped := fs.usage[target].priority[lowest]
+	if err := fs.removeSegment(target); err != nil {
+		return fmt.Errorf("failed to drop segment: %v", err)
+	}
+	fs.dequeueReplay(target)
+
+	fs.droppedBytes.WithLabelValues(overflowDropLowestPriority).Add(float64(dropped))
+	fs.logger.Warn("Dropped lowest priority items to make room",
+		zap.String("segment", target),
+		zap.Uint8("priority", lowest),
+		zap.Int64("bytes", dropped))
+	return nil
+}
+
+// compactionLoop rewrites segments without their lowest priority items as
+// dropLowestPriority asks for it
+func (fs *FileStorageExtension) compactionLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case c := <-fs.compactions:
+			if err := fs.compactPriority(c); err != nil {
+				fs.logger.Error("Failed to drop lowest priority items",
+					zap.String("segment", c.path),
+					zap.Uint8("priority", c.priority),
+					zap.Error(err))
+			}
+		}
+	}
+}
+
+// compactPriority rewrites a segment without the items of a priority class,
+// holding the mutex only to replace the segment. The rewrite is discarded if
+// the segment changed or replay started reading it in the meantime.
+func (fs *FileStorageExtension) compactPriority(c priorityCompaction) error {
+	tmpPath, ix, err := fs.rewriteSegment(c.path, int64(headerSize), func(rec record) bool {
+		return rec.priority != c.priority
+	})
+	if err != nil {
+		return err
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if fs.usage[c.path] != c.usage || fs.isReplaying(c.path) {
+		os.Remove(tmpPath)
+		return nil
+	}
+	if err := os.Rename(tmpPath, c.path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to replace segment: %v", err)
+	}
+	fs.writeSegmentIndex(c.path, ix)
+
+	dropped := c.usage.size
+	fs.trackSegment(c.path)
+	if usage, ok := fs.usage[c.path]; ok {
+		dropped -= usage.size
+	}
+	fs.updateMetricsLocked()
+
+	fs.droppedBytes.WithLabelValues(overflowDropLowestPriority).Add(float64(dropped))
+	fs.logger.Warn("Dropped lowest priority items to make room",
+		zap.String("segment", c.path),
+		zap.Uint8("priority", c.priority),
+		zap.Int64("bytes", dropped))
+	return nil
+}
+
+// isReplaying reports whether replay is reading a segment, or will resume
+// reading it from the cursor. Callers must hold the mutex.
+func (fs *FileStorageExtension) isReplaying(path string) bool {
+	if filepath.Base(path) == fs.cursor.Segment {
+		return true
+	}
+	return fs.replayActive && len(fs.replayQueue) > 0 && fs.replayQueue[0] == path
+}
+
+// trackedSegments returns the tracked segments, oldest first. Callers must
+// hold the mutex.
+func (fs *FileStorageExtension) trackedSegments() []string {
+	paths := make([]string, 0, len(fs.usage))
+	for path := range fs.usage {
+		paths = append(paths, path)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return filepath.Base(paths[i]) < filepath.Base(paths[j])
+	})
+	return paths
+}
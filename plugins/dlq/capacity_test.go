@@ -0,0 +1,156 @@
+package dlq
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOverflowPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		// segments holds the priority of every item of the two finalized
+		// segments, oldest first
+		segments      [][]uint8
+		replayFirst   bool // replay is reading the oldest segment
+		writePriority uint8
+		wantErr       error
+		wantKept      []bool
+		// wantCompacted is the priority of the items the oldest segment
+		// holds once the compaction loop rewrote it, after which the write
+		// is retried and must succeed
+		wantCompacted []uint8
+	}{
+		{
+			name:     "reject",
+			policy:   overflowReject,
+			segments: [][]uint8{{0, 0}, {0, 0}},
+			wantErr:  ErrFull,
+			wantKept: []bool{true, true},
+		},
+		{
+			name:     "drop oldest",
+			policy:   overflowDropOldest,
+			segments: [][]uint8{{0, 0}, {0, 0}},
+			wantKept: []bool{false, true},
+		},
+		{
+			name:        "drop oldest skips the segment replay is reading",
+			policy:      overflowDropOldest,
+			segments:    [][]uint8{{0, 0}, {0, 0}},
+			replayFirst: true,
+			wantKept:    []bool{true, false},
+		},
+		{
+			name:          "drop lowest priority deletes a segment holding only them",
+			policy:        overflowDropLowestPriority,
+			segments:      [][]uint8{{2, 2}, {1, 1}},
+			writePriority: 2,
+			wantKept:      []bool{true, false},
+		},
+		{
+			name:          "drop lowest priority rewrites in the background",
+			policy:        overflowDropLowestPriority,
+			segments:      [][]uint8{{0, 2, 0}, {2, 2}},
+			writePriority: 2,
+			wantErr:       ErrFull,
+			wantKept:      []bool{true, true},
+			wantCompacted: []uint8{2},
+		},
+		{
+			name:          "drop lowest priority prefers deleting a later segment to a rewrite",
+			policy:        overflowDropLowestPriority,
+			segments:      [][]uint8{{0, 2, 0}, {0, 0}},
+			writePriority: 2,
+			wantKept:      []bool{true, false},
+		},
+		{
+			name:          "drop lowest priority keeps higher priorities",
+			policy:        overflowDropLowestPriority,
+			segments:      [][]uint8{{2, 2}, {2, 2}},
+			writePriority: 1,
+			wantErr:       ErrFull,
+			wantKept:      []bool{true, true},
+		},
+		{
+			name:          "drop lowest priority skips the segment replay is reading",
+			policy:        overflowDropLowestPriority,
+			segments:      [][]uint8{{0, 0}, {2, 2}},
+			replayFirst:   true,
+			writePriority: 2,
+			wantKept:      []bool{true, false},
+		},
+	}
+
+	// Every item compresses to the same size, so dropping one makes room
+	// for another
+	item := bytes.Repeat([]byte("overflow;"), 16)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := newTestStorage(t, func(cfg *FileStorageConfig) {
+				cfg.OverflowPolicy = tt.policy
+			})
+
+			var paths []string
+			for _, priorities := range tt.segments {
+				for _, priority := range priorities {
+					if err := fs.StorePriorityItem(item, priority); err != nil {
+						t.Fatal(err)
+					}
+				}
+				path, _ := finalizeTestSegment(t, fs)
+				paths = append(paths, path)
+			}
+
+			// Leave no room at all
+			fs.mutex.Lock()
+			fs.config.MaxTotalBytes = fs.usedBytes()
+			if tt.replayFirst {
+				fs.cursor = replayCursor{Segment: filepath.Base(paths[0]), Offset: int64(headerSize)}
+			}
+			fs.mutex.Unlock()
+
+			err := fs.StorePriorityItem(item, tt.writePriority)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("StorePriorityItem() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if tt.wantCompacted != nil {
+				// Wait for the compaction loop to rewrite the segment
+				var priorities []uint8
+				for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+					priorities = priorities[:0]
+					for _, rec := range readSegmentRecords(t, paths[0]) {
+						priorities = append(priorities, rec.priority)
+					}
+					if len(priorities) == len(tt.wantCompacted) {
+						break
+					}
+				}
+				if !bytes.Equal(priorities, tt.wantCompacted) {
+					t.Fatalf("compacted segment holds priorities %v, want %v", priorities, tt.wantCompacted)
+				}
+				if err := fs.StorePriorityItem(item, tt.writePriority); err != nil {
+					t.Fatalf("StorePriorityItem() after compaction: %v", err)
+				}
+			}
+
+			for i, path := range paths {
+				_, err := os.Stat(path)
+				if kept := err == nil; kept != tt.wantKept[i] {
+					t.Errorf("segment %d kept = %v, want %v", i, kept, tt.wantKept[i])
+				}
+			}
+			fs.mutex.Lock()
+			defer fs.mutex.Unlock()
+			if used := fs.usedBytes(); used > fs.config.MaxTotalBytes {
+				t.Errorf("DLQ holds %d bytes, over the limit of %d", used, fs.config.MaxTotalBytes)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package dlq
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Replay progress is kept in a cursor file in the DLQ directory, so replay
+// resumes where it left off instead of starting over after every pause or
+// restart. The cursor only moves past an item once the callback accepted it,
+// so replay is at-least-once. Saving it syncs the file and the directory, so
+// it is saved at most once per cursorSaveInterval while replay runs, and
+// whenever a segment completes or replay stops: after a crash, at most the
+// items delivered during the last interval are sent again.
+
+const (
+	cursorFileName     = "replay.cursor"
+	cursorSaveInterval = time.Second
+)
+
+// replayCursor is the position replay has reached: every item of Segment
+// before Offset was delivered. Replayed lists the segments replay read to
+// their end without error that were not released yet. Segments are only
+// released once listed, so a segment replay skipped or never read is kept.
+type replayCursor struct {
+	Segment  string   `json:"segment"`
+	Offset   int64    `json:"offset"`
+	Replayed []string `json:"replayed,omitempty"`
+}
+
+// offsetIn returns where replay of a segment resumes
+func (c replayCursor) offsetIn(segment string) int64 {
+	if segment == c.Segment {
+		return c.Offset
+	}
+	return 0
+}
+
+// covers reports whether a segment was entirely replayed
+func (c replayCursor) covers(segment string) bool {
+	for _, replayed := range c.Replayed {
+		if replayed == segment {
+			return true
+		}
+	}
+	return false
+}
+
+// withReplayed returns the cursor listing a segment as replayed. The list is
+// copied rather than changed, as saving the cursor reads it without the
+// mutex.
+func (c replayCursor) withReplayed(segment string) replayCursor {
+	if c.covers(segment) {
+		return c
+	}
+	c.Replayed = append(c.Replayed[:len(c.Replayed):len(c.Replayed)], segment)
+	return c
+}
+
+// withoutReplayed returns the cursor no longer listing a segment
+func (c replayCursor) withoutReplayed(segment string) replayCursor {
+	if !c.covers(segment) {
+		return c
+	}
+	replayed := make([]string, 0, len(c.Replayed)-1)
+	for _, s := range c.Replayed {
+		if s != segment {
+			replayed = append(replayed, s)
+		}
+	}
+	c.Replayed = replayed
+	return c
+}
+
+// loadCursor reads the saved cursor, if any
+func (fs *FileStorageExtension) loadCursor() error {
+	data, err := os.ReadFile(filepath.Join(fs.config.Directory, cursorFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read replay cursor: %v", err)
+	}
+
+	var cursor replayCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		// Replaying everything again beats losing data
+		fs.logger.Warn("Ignoring unreadable replay cursor", zap.Error(err))
+		return nil
+	}
+
+	fs.mutex.Lock()
+	fs.cursor = cursor
+	fs.mutex.Unlock()
+	return nil
+}
+
+// advanceCursor moves the cursor to an offset in a segment, saving it once
+// cursorSaveInterval passed since the last save
+func (fs *FileStorageExtension) advanceCursor(segment string, offset int64) {
+	fs.mutex.Lock()
+	fs.cursor.Segment = segment
+	fs.cursor.Offset = offset
+	fs.cursorDirty = true
+	due := time.Since(fs.cursorSavedAt) >= cursorSaveInterval
+	fs.mutex.Unlock()
+
+	if due {
+		fs.flushCursor()
+	}
+}
+
+// flushCursor saves the cursor if it moved since it was last saved
+func (fs *FileStorageExtension) flushCursor() {
+	// Saves run one at a time, each taking the cursor once the previous one
+	// finished, so an older cursor never replaces a newer one
+	fs.cursorSaveMutex.Lock()
+	defer fs.cursorSaveMutex.Unlock()
+
+	fs.mutex.Lock()
+	if !fs.cursorDirty {
+		fs.mutex.Unlock()
+		return
+	}
+	cursor := fs.cursor
+	fs.cursorDirty = false
+	fs.cursorSavedAt = time.Now()
+	fs.mutex.Unlock()
+
+	if err := saveCursor(fs.config.Directory, cursor); err != nil {
+		fs.logger.Warn("Failed to save replay cursor",
+			zap.String("segment", cursor.Segment),
+			zap.Int64("offset", cursor.Offset),
+			zap.Error(err))
+		fs.mutex.Lock()
+		fs.cursorDirty = true
+		fs.mutex.Unlock()
+	}
+}
+
+// saveCursor atomically and durably replaces the cursor file
+func saveCursor(dir string, cursor replayCursor) error {
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		return fmt.Errorf("failed to encode replay cursor: %v", err)
+	}
+
+	path := filepath.Join(dir, cursorFileName)
+	tmp, err := os.CreateTemp(dir, cursorFileName+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create replay cursor: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write replay cursor: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync replay cursor: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close replay cursor: %v", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace replay cursor: %v", err)
+	}
+	return syncDir(dir)
+}
@@ -0,0 +1,266 @@
+package dlq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// readSavedCursor returns the cursor saved in a DLQ directory
+func readSavedCursor(t *testing.T, dir string) replayCursor {
+	t.Helper()
+	var cursor replayCursor
+	data, err := os.ReadFile(filepath.Join(dir, cursorFileName))
+	if os.IsNotExist(err) {
+		return cursor
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		t.Fatal(err)
+	}
+	return cursor
+}
+
+func TestAdvanceCursor(t *testing.T) {
+	tests := []struct {
+		name      string
+		savedAgo  time.Duration
+		wantSaved bool
+	}{
+		{name: "saved within the interval", savedAgo: 0, wantSaved: false},
+		{name: "saved before the interval", savedAgo: 2 * cursorSaveInterval, wantSaved: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := newTestStorage(t, nil)
+			fs.mutex.Lock()
+			fs.cursorSavedAt = time.Now().Add(-tt.savedAgo)
+			fs.mutex.Unlock()
+
+			moved := replayCursor{Segment: "segment_1.dlq", Offset: 100}
+			fs.advanceCursor(moved.Segment, moved.Offset)
+
+			saved := readSavedCursor(t, fs.config.Directory)
+			if (saved.Segment == moved.Segment && saved.Offset == moved.Offset) != tt.wantSaved {
+				t.Errorf("saved cursor %+v after advancing to %+v, want saved %v", saved, moved, tt.wantSaved)
+			}
+			fs.mutex.Lock()
+			if fs.cursor.Segment != moved.Segment || fs.cursor.Offset != moved.Offset {
+				t.Errorf("cursor = %+v, want %+v", fs.cursor, moved)
+			}
+			fs.mutex.Unlock()
+
+			// Flushing always saves the latest cursor
+			fs.flushCursor()
+			saved = readSavedCursor(t, fs.config.Directory)
+			if saved.Segment != moved.Segment || saved.Offset != moved.Offset {
+				t.Errorf("flushed cursor %+v, want %+v", saved, moved)
+			}
+		})
+	}
+}
+
+func TestReplayUnreadableSegment(t *testing.T) {
+	tests := []struct {
+		name string
+		// damage is applied to the finalized segment, or to the segment being
+		// written if damageCurrent is set, given the offsets of its items
+		damage          func(path string, offsets []int64) error
+		damageCurrent   bool
+		wantItems       []string
+		wantQuarantined bool
+		wantActive      bool
+	}{
+		{
+			name: "torn segment is quarantined",
+			damage: func(path string, offsets []int64) error {
+				return os.Truncate(path, offsets[2]+5)
+			},
+			wantItems:       []string{"a0", "a1", "b0", "b1"},
+			wantQuarantined: true,
+		},
+		{
+			name:      "missing segment is skipped",
+			damage:    func(path string, _ []int64) error { return os.Remove(path) },
+			wantItems: []string{"b0", "b1"},
+		},
+		{
+			name: "torn segment being written keeps the cursor",
+			damage: func(path string, offsets []int64) error {
+				return os.Truncate(path, offsets[1]+5)
+			},
+			damageCurrent: true,
+			wantItems:     []string{"a0", "a1", "a2", "a3", "b0"},
+			wantActive:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := newTestStorage(t, func(cfg *FileStorageConfig) {
+				cfg.Replay.InterleaveRatio = 1
+			})
+
+			for i := 0; i < 4; i++ {
+				if err := fs.StoreItem([]byte(fmt.Sprintf("a%d", i))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			finalized, finalizedOffsets := finalizeTestSegment(t, fs)
+			for i := 0; i < 2; i++ {
+				if err := fs.StoreItem([]byte(fmt.Sprintf("b%d", i))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			fs.mutex.Lock()
+			current := fs.currentSegment.Name()
+			currentOffsets := make([]int64, 0, len(fs.currentIndex.Records))
+			for _, entry := range fs.currentIndex.Records {
+				currentOffsets = append(currentOffsets, entry.Offset)
+			}
+			fs.mutex.Unlock()
+
+			damaged, damagedOffsets := finalized, finalizedOffsets
+			if tt.damageCurrent {
+				damaged, damagedOffsets = current, currentOffsets
+			}
+			if err := tt.damage(damaged, damagedOffsets); err != nil {
+				t.Fatal(err)
+			}
+
+			var mu sync.Mutex
+			var items []string
+			err := fs.StartReplay(context.Background(), func(item []byte) error {
+				mu.Lock()
+				items = append(items, string(item))
+				mu.Unlock()
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Wait for replay to deliver everything it can, then give it
+			// time to move on if it wrongly would
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				mu.Lock()
+				delivered := len(items)
+				mu.Unlock()
+				if delivered >= len(tt.wantItems) || time.Now().After(deadline) {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			time.Sleep(300 * time.Millisecond)
+
+			mu.Lock()
+			got := fmt.Sprint(items)
+			mu.Unlock()
+			if got != fmt.Sprint(tt.wantItems) {
+				t.Errorf("replayed %v, want %v", got, tt.wantItems)
+			}
+
+			fs.mutex.Lock()
+			active := fs.replayActive
+			cursor := fs.cursor
+			fs.mutex.Unlock()
+			if active != tt.wantActive {
+				t.Errorf("replay active = %v, want %v", active, tt.wantActive)
+			}
+			if tt.wantActive {
+				want := replayCursor{Segment: filepath.Base(current), Offset: currentOffsets[1]}
+				if cursor.Segment != want.Segment || cursor.Offset != want.Offset {
+					t.Errorf("cursor = %+v, want it pinned at %+v", cursor, want)
+				}
+				if err := fs.StopReplay(); err != nil {
+					t.Fatal(err)
+				}
+			} else if saved := readSavedCursor(t, fs.config.Directory); fmt.Sprint(saved) != fmt.Sprint(cursor) {
+				// Completing replay saves the cursor
+				t.Errorf("saved cursor %+v, want %+v", saved, cursor)
+			}
+
+			_, err = os.Stat(filepath.Join(fs.config.QuarantineDirectory, filepath.Base(finalized)))
+			if quarantined := err == nil; quarantined != tt.wantQuarantined {
+				t.Errorf("quarantined = %v, want %v", quarantined, tt.wantQuarantined)
+			}
+		})
+	}
+}
+
+func TestStopReplayWaitsForLoop(t *testing.T) {
+	tests := []struct {
+		name string
+		stop func(fs *FileStorageExtension) error
+	}{
+		{name: "stop replay", stop: func(fs *FileStorageExtension) error { return fs.StopReplay() }},
+		{name: "shutdown", stop: func(fs *FileStorageExtension) error { return fs.Shutdown(context.Background()) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := newTestStorage(t, func(cfg *FileStorageConfig) {
+				cfg.Replay.InterleaveRatio = 1
+			})
+			for i := 0; i < 200; i++ {
+				if err := fs.StoreItem([]byte(fmt.Sprintf("item-%d", i))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			finalizeTestSegment(t, fs)
+
+			var mu sync.Mutex
+			delivered := 0
+			err := fs.StartReplay(context.Background(), func([]byte) error {
+				time.Sleep(time.Millisecond)
+				mu.Lock()
+				delivered++
+				mu.Unlock()
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for started := false; !started; time.Sleep(5 * time.Millisecond) {
+				mu.Lock()
+				started = delivered > 0
+				mu.Unlock()
+			}
+
+			if err := tt.stop(fs); err != nil {
+				t.Fatal(err)
+			}
+			mu.Lock()
+			stoppedAt := delivered
+			mu.Unlock()
+
+			// The loop exited, so nothing is delivered after and the saved
+			// cursor holds everything that was
+			time.Sleep(100 * time.Millisecond)
+			mu.Lock()
+			after := delivered
+			mu.Unlock()
+			if after != stoppedAt {
+				t.Errorf("delivered %d items after stopping", after-stoppedAt)
+			}
+			fs.mutex.Lock()
+			active, cursor := fs.replayActive, fs.cursor
+			fs.mutex.Unlock()
+			if active {
+				t.Error("replay still active after stopping")
+			}
+			if saved := readSavedCursor(t, fs.config.Directory); saved.Segment != cursor.Segment || saved.Offset != cursor.Offset {
+				t.Errorf("saved cursor %+v, want %+v", saved, cursor)
+			}
+		})
+	}
+}
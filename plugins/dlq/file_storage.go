@@ -1,19 +1,22 @@
 package dlq
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
-	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.opentelemetry.io/collector/component"
 	"go.opentelemetry.io/collector/extension"
+	"go.opentelemetry.io/collector/extension/experimental/storage"
 	"go.uber.org/zap"
 
 	"github.com/klauspost/compress/zstd"
@@ -22,30 +25,61 @@ import (
 )
 
 const (
-	// File format constants
-	magicBytes     = "NRDQv1"
-	headerSize     = 32 // Magic(6) + ItemCount(8) + SHA256(32-6-8=18 remaining)
 	defaultMaxSize = 128 * 1024 * 1024 // 128 MiB per segment
 	
-	// Replay rates
-	defaultReplayRateMiBps = 4  // 4 MiB/s
-	replayTokenInterval    = 10 * time.Millisecond
+	defaultDirectory            = "/var/lib/nrdotplus/dlq"
+	defaultVerificationInterval = 10 * time.Minute
+	defaultQuarantineDirectory  = "quarantine"
 )
 
+// errReplayCallback marks a replay error returned by the callback, as opposed
+// to one reading the segment
+var errReplayCallback = errors.New("callback failed")
+
 // FileStorageConfig holds the configuration for the file-backed DLQ
 type FileStorageConfig struct {
 	Directory           string        `mapstructure:"directory"`
 	MaxSegmentMiB       int           `mapstructure:"max_segment_mib"`
 	VerificationInterval time.Duration `mapstructure:"verification_interval"`
+	
+	// QuarantineDirectory receives corrupted segments, by default the
+	// quarantine directory inside Directory
+	QuarantineDirectory string `mapstructure:"quarantine_directory"`
+	
+	// Salvage copies the readable items of a corrupted segment back into
+	// the DLQ when it is quarantined
+	Salvage bool `mapstructure:"salvage"`
+	
+	// ArchiveDirectory receives fully replayed segments. If empty they are
+	// deleted.
+	ArchiveDirectory string `mapstructure:"archive_directory"`
+	
+	// MaxTotalBytes bounds the bytes of all segments together, storage
+	// client segments included
+	MaxTotalBytes int64 `mapstructure:"max_total_bytes"`
+	
+	// OverflowPolicy is what happens to a write that does not fit:
+	// reject, drop_oldest or drop_lowest_priority
+	OverflowPolicy string `mapstructure:"overflow_policy"`
+	
+	// MaxAge expires items that have been in the DLQ for longer. Zero keeps
+	// items until they are replayed.
+	MaxAge time.Duration `mapstructure:"max_age"`
+	
+	// Replay sets the replay rate and how replay interleaves with live
+	// traffic
+	Replay ReplayConfig `mapstructure:"replay"`
 }
 
-// FileStorageExtension implements a file-based DLQ with SHA-256 verification
+// FileStorageExtension implements a file-based DLQ with SHA-256 and per-item
+// CRC32C verification
 type FileStorageExtension struct {
 	config           *FileStorageConfig
 	logger           *zap.Logger
 	currentSegment   *os.File
 	currentSize      int64
 	currentItemCount int64
+	currentIndex     *segmentIndex
 	hasher           hash.Hash
 	compressor       *zstd.Encoder
 	mutex            sync.Mutex
@@ -53,13 +87,41 @@ type FileStorageExtension struct {
 	// Replay functionality
 	replayQueue     []string // List of segments to replay
 	replayActive    bool
-	replayCtx       context.Context
 	replayCancel    context.CancelFunc
+	replayDone      chan struct{} // closed when the replay loop exits
+	cursor          replayCursor
+	cursorDirty     bool       // cursor moved since it was last saved
+	cursorSavedAt   time.Time  // when the cursor was last saved
+	cursorSaveMutex sync.Mutex // orders cursor saves
+	
+	// Bytes held by each segment, by path, and by all of them
+	usage      map[string]*segmentUsage
+	totalBytes int64
+	
+	// Segments to rewrite without their lowest priority items
+	compactions chan priorityCompaction
+	
+	// Background loops, stopped by Shutdown
+	loops       sync.WaitGroup
+	loopsCancel context.CancelFunc
+	
+	// Storage clients handed out to other components, by directory name,
+	// and the bytes of all client segments on disk
+	clients      map[string]*fileStorageClient
+	storageBytes atomic.Int64
 	
 	// Metrics
 	utilizationRatio prometheus.Gauge
 	oldestAgeSeconds prometheus.Gauge
 	corruptedTotal   prometheus.Counter
+	recoveredTotal   prometheus.Counter
+	salvagedTotal    prometheus.Counter
+	corruptedItemsTotal prometheus.Counter
+	reclaimedBytes      *prometheus.CounterVec
+	droppedBytes        *prometheus.CounterVec
+	rejectedTotal       prometheus.Counter
+	expiredRecords      *prometheus.CounterVec
+	replayRateBytes     prometheus.Gauge
 }
 
 // metrics
@@ -84,6 +146,65 @@ var (
 			Help: "Total number of corrupted segments detected",
 		},
 	)
+	
+	dlqRecoveredTotalMetric = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "dlq_recovered_records_total",
+			Help: "Total number of records recovered from segments left unfinalized by a crash",
+		},
+	)
+	
+	dlqSalvagedTotalMetric = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "dlq_salvaged_records_total",
+			Help: "Total number of records salvaged from quarantined segments",
+		},
+	)
+	
+	dlqCorruptedItemsTotalMetric = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "dlq_corrupted_items_total",
+			Help: "Total number of damaged items skipped while reading segments",
+		},
+	)
+	
+	dlqReclaimedBytesMetric = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dlq_reclaimed_bytes_total",
+			Help: "Total number of bytes reclaimed from replayed segments, by action",
+		},
+		[]string{"action"},
+	)
+	
+	dlqDroppedBytesMetric = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dlq_dropped_bytes_total",
+			Help: "Total number of bytes dropped to stay within max_total_bytes, by overflow policy",
+		},
+		[]string{"policy"},
+	)
+	
+	dlqRejectedTotalMetric = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "dlq_rejected_items_total",
+			Help: "Total number of items rejected because the DLQ was full",
+		},
+	)
+	
+	dlqExpiredRecordsMetric = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dlq_expired_records_total",
+			Help: "Total number of records expired by max_age, by action",
+		},
+		[]string{"action"},
+	)
+	
+	dlqReplayRateMetric = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "dlq_replay_rate_bytes",
+			Help: "Current replay rate of the DLQ in bytes per second",
+		},
+	)
 )
 
 // NewFileStorage creates a new file-backed DLQ extension
@@ -98,22 +219,72 @@ func NewFileStorage(config *FileStorageConfig, logger *zap.Logger) (*FileStorage
 	}
 	
 	if config.VerificationInterval <= 0 {
-		config.VerificationInterval = 10 * time.Minute
+		config.VerificationInterval = defaultVerificationInterval
+	}
+	
+	if config.QuarantineDirectory == "" {
+		config.QuarantineDirectory = filepath.Join(config.Directory, defaultQuarantineDirectory)
+	}
+	
+	if config.MaxTotalBytes <= 0 {
+		config.MaxTotalBytes = defaultMaxTotalBytes
+	}
+	
+	if config.OverflowPolicy == "" {
+		config.OverflowPolicy = defaultOverflowPolicy
 	}
 	
-	// Create directory if it doesn't exist
+	if config.Replay.RateMiBps <= 0 {
+		config.Replay.RateMiBps = defaultReplayRateMiBps
+	}
+	if config.Replay.BurstMiB <= 0 {
+		config.Replay.BurstMiB = defaultReplayBurstMiB
+	}
+	if config.Replay.InterleaveRatio <= 0 {
+		config.Replay.InterleaveRatio = defaultReplayInterleaveRatio
+	}
+	if config.Replay.Adaptive.MinRateMiBps <= 0 {
+		config.Replay.Adaptive.MinRateMiBps = defaultReplayMinRateMiBps
+	}
+	if config.Replay.Adaptive.MaxRateMiBps <= 0 {
+		config.Replay.Adaptive.MaxRateMiBps = defaultReplayMaxRateMiBps
+	}
+	if config.Replay.Adaptive.LatencyFactor <= 0 {
+		config.Replay.Adaptive.LatencyFactor = defaultReplayLatencyFactor
+	}
+	
+	// Create directories if they don't exist
 	if err := os.MkdirAll(config.Directory, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create directory: %v", err)
 	}
+	if err := os.MkdirAll(config.QuarantineDirectory, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create quarantine directory: %v", err)
+	}
+	if config.ArchiveDirectory != "" {
+		if err := os.MkdirAll(config.ArchiveDirectory, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create archive directory: %v", err)
+		}
+	}
 	
 	// Initialize storage
 	fs := &FileStorageExtension{
 		config:           config,
 		logger:           logger,
 		hasher:           sha256.New(),
+		usage:            make(map[string]*segmentUsage),
+		compactions:      make(chan priorityCompaction, 1),
+		clients:          make(map[string]*fileStorageClient),
 		utilizationRatio: dlqUtilizationRatioMetric,
 		oldestAgeSeconds: dlqOldestAgeSecondsMetric,
 		corruptedTotal:   dlqCorruptedTotalMetric,
+		recoveredTotal:   dlqRecoveredTotalMetric,
+		salvagedTotal:    dlqSalvagedTotalMetric,
+		corruptedItemsTotal: dlqCorruptedItemsTotalMetric,
+		reclaimedBytes:      dlqReclaimedBytesMetric,
+		droppedBytes:        dlqDroppedBytesMetric,
+		rejectedTotal:       dlqRejectedTotalMetric,
+		expiredRecords:      dlqExpiredRecordsMetric,
+		replayRateBytes:     dlqReplayRateMetric,
 	}
 	
 	// Initialize zstd compressor
@@ -128,13 +299,45 @@ func NewFileStorage(config *FileStorageConfig, logger *zap.Logger) (*FileStorage
 
 // Start the extension
 func (fs *FileStorageExtension) Start(ctx context.Context, host component.Host) error {
+	// Finalize segments a crash left open, before a new one is created
+	if err := fs.recoverSegments(); err != nil {
+		return fmt.Errorf("failed to recover segments: %v", err)
+	}
+	
+	// Resume replay where it left off
+	if err := fs.loadCursor(); err != nil {
+		return err
+	}
+	
+	// Reclaim what replay acknowledged before the last shutdown
+	fs.removeStaleCompactions()
+	fs.reclaimReplayed()
+	
+	// Account for what the remaining segments hold
+	if err := fs.scanUsage(); err != nil {
+		return fmt.Errorf("failed to scan segments: %v", err)
+	}
+	
 	// Create a new segment if none exists
 	if err := fs.rotateSegmentIfNeeded(); err != nil {
 		return fmt.Errorf("failed to initialize segment: %v", err)
 	}
 	
+	// Background loops run until Shutdown, not for as long as the context
+	// Start was called with
+	loopCtx, cancel := context.WithCancel(context.Background())
+	fs.loopsCancel = cancel
+	
 	// Start verification loop
-	go fs.verificationLoop(ctx)
+	fs.runLoop(loopCtx, fs.verificationLoop)
+	
+	// Start expiring items past max_age
+	if fs.config.MaxAge > 0 {
+		fs.runLoop(loopCtx, fs.retentionLoop)
+	}
+	
+	// Start rewriting segments drop_lowest_priority asks for
+	fs.runLoop(loopCtx, fs.compactionLoop)
 	
 	// Update metrics initially
 	fs.updateMetrics()
@@ -142,15 +345,34 @@ func (fs *FileStorageExtension) Start(ctx context.Context, host component.Host)
 	return nil
 }
 
-// Stop the extension
-func (fs *FileStorageExtension) Stop(ctx context.Context) error {
+// Shutdown stops the extension and its background loops, closing any
+// storage clients still open
+func (fs *FileStorageExtension) Shutdown(ctx context.Context) error {
 	fs.mutex.Lock()
-	defer fs.mutex.Unlock()
+	clients := make([]*fileStorageClient, 0, len(fs.clients))
+	for _, client := range fs.clients {
+		clients = append(clients, client)
+	}
+	fs.mutex.Unlock()
 	
-	// Stop any active replay
-	if fs.replayActive && fs.replayCancel != nil {
-		fs.replayCancel()
+	for _, client := range clients {
+		if err := client.Close(ctx); err != nil {
+			fs.logger.Error("Failed to close storage client during shutdown",
+				zap.String("client", client.name),
+				zap.Error(err))
+		}
+	}
+	
+	// Stop replay and the background loops, which take the mutex, before
+	// holding it. The replay loop saves the cursor as it exits.
+	fs.stopReplayLoop()
+	if fs.loopsCancel != nil {
+		fs.loopsCancel()
 	}
+	fs.loops.Wait()
+	
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
 	
 	// Close current segment
 	if fs.currentSegment != nil {
@@ -166,8 +388,36 @@ func (fs *FileStorageExtension) Stop(ctx context.Context) error {
 	return nil
 }
 
-// StoreItem persists an item to the DLQ
+// runLoop runs a background loop until Shutdown stops it
+func (fs *FileStorageExtension) runLoop(ctx context.Context, loop func(context.Context)) {
+	fs.loops.Add(1)
+	go func() {
+		defer fs.loops.Done()
+		loop(ctx)
+	}()
+}
+
+// StoreItem persists an item to the DLQ with the lowest priority
 func (fs *FileStorageExtension) StoreItem(item []byte) error {
+	return fs.StoreItemWithMetadata(item, ItemMetadata{})
+}
+
+// StorePriorityItem persists an item to the DLQ with a priority class, higher
+// values being more important
+func (fs *FileStorageExtension) StorePriorityItem(item []byte, priority uint8) error {
+	return fs.StoreItemWithMetadata(item, ItemMetadata{Priority: priority})
+}
+
+// StoreItemWithMetadata persists an item to the DLQ, recording its metadata
+// in the segment index. If the item does not fit, the overflow policy makes
+// room for it or it is rejected with ErrFull.
+func (fs *FileStorageExtension) StoreItemWithMetadata(item []byte, meta ItemMetadata) error {
+	return fs.storeItem(item, meta, time.Now().UnixNano())
+}
+
+// storeItem persists an item that entered the DLQ at storedAt, in Unix
+// nanoseconds
+func (fs *FileStorageExtension) storeItem(item []byte, meta ItemMetadata, storedAt int64) error {
 	fs.mutex.Lock()
 	defer fs.mutex.Unlock()
 	
@@ -179,23 +429,35 @@ func (fs *FileStorageExtension) StoreItem(item []byte) error {
 	// Compress the item
 	compressed := fs.compressor.EncodeAll(item, nil)
 	
+	// Stay within the total size
+	if err := fs.makeRoom(currentFormat.recordOverhead()+int64(len(compressed)), meta.Priority); err != nil {
+		if errors.Is(err, ErrFull) {
+			fs.rejectedTotal.Inc()
+		}
+		return err
+	}
+	
 	// Update hash
 	fs.hasher.Write(compressed)
 	
 	// Write size and data
-	sizeBytes := make([]byte, 4)
-	binary.BigEndian.PutUint32(sizeBytes, uint32(len(compressed)))
-	
-	if _, err := fs.currentSegment.Write(sizeBytes); err != nil {
-		return fmt.Errorf("failed to write item size: %v", err)
-	}
-	
-	if _, err := fs.currentSegment.Write(compressed); err != nil {
-		return fmt.Errorf("failed to write item data: %v", err)
+	rec := record{data: compressed, priority: meta.Priority, storedAt: storedAt}
+	written, err := writeRecord(fs.currentSegment, rec)
+	if err != nil {
+		return err
 	}
 	
-	// Update counters
-	fs.currentSize += int64(len(sizeBytes) + len(compressed))
+	// Update counters and the index
+	fs.trackWrite(fs.currentSegment.Name(), rec, written)
+	fs.currentIndex.add(indexRecord{
+		Offset:   fs.currentSize,
+		Size:     written,
+		StoredAt: rec.storedAt,
+		Priority: meta.Priority,
+		Signal:   meta.Signal,
+		Tenant:   meta.Tenant,
+	})
+	fs.currentSize += written
 	fs.currentItemCount++
 	
 	// Rotate if needed
@@ -206,16 +468,27 @@ func (fs *FileStorageExtension) StoreItem(item []byte) error {
 	}
 	
 	// Update metrics
-	fs.updateMetrics()
+	fs.updateMetricsLocked()
 	
 	return nil
 }
 
 // StartReplay begins replaying items from the DLQ
 func (fs *FileStorageExtension) StartReplay(ctx context.Context, callback func([]byte) error) error {
+	fs.mutex.Lock()
+	active := fs.replayActive
+	fs.mutex.Unlock()
+	if active {
+		return errors.New("replay already in progress")
+	}
+	
+	// Reclaim what earlier replays acknowledged, before listing what is
+	// left to replay
+	fs.reclaimReplayed()
+	
 	fs.mutex.Lock()
 	
-	// Check if replay is already active
+	// Check again, as replay may have been started while reclaiming
 	if fs.replayActive {
 		fs.mutex.Unlock()
 		return errors.New("replay already in progress")
@@ -228,6 +501,15 @@ func (fs *FileStorageExtension) StartReplay(ctx context.Context, callback func([
 		return fmt.Errorf("failed to list segments: %v", err)
 	}
 	
+	// Keep segments the cursor says were already replayed out of the queue
+	pending := segments[:0]
+	for _, segmentPath := range segments {
+		if !fs.cursor.covers(filepath.Base(segmentPath)) {
+			pending = append(pending, segmentPath)
+		}
+	}
+	segments = pending
+	
 	// No segments to replay
 	if len(segments) == 0 {
 		fs.mutex.Unlock()
@@ -235,37 +517,51 @@ func (fs *FileStorageExtension) StartReplay(ctx context.Context, callback func([
 	}
 	
 	// Set up replay state
+	replayCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
 	fs.replayQueue = segments
 	fs.replayActive = true
-	fs.replayCtx, fs.replayCancel = context.WithCancel(ctx)
+	fs.replayCancel = cancel
+	fs.replayDone = done
 	fs.mutex.Unlock()
 	
 	// Start replay goroutine
-	go fs.replayLoop(callback)
+	go func() {
+		defer close(done)
+		fs.replayLoop(replayCtx, callback)
+	}()
 	
 	return nil
 }
 
-// StopReplay stops an active replay
+// StopReplay stops an active replay, returning once the replay loop exited
 func (fs *FileStorageExtension) StopReplay() error {
 	fs.mutex.Lock()
-	defer fs.mutex.Unlock()
-	
 	if !fs.replayActive {
+		fs.mutex.Unlock()
 		return errors.New("no replay in progress")
 	}
+	fs.mutex.Unlock()
 	
-	// Cancel the context to stop the replay
-	if fs.replayCancel != nil {
-		fs.replayCancel()
-	}
-	
-	fs.replayActive = false
-	fs.replayQueue = nil
-	
+	fs.stopReplayLoop()
 	return nil
 }
 
+// stopReplayLoop cancels the replay loop, if any, and waits for it to exit,
+// which resets the replay state and saves the cursor
+func (fs *FileStorageExtension) stopReplayLoop() {
+	fs.mutex.Lock()
+	cancel, done := fs.replayCancel, fs.replayDone
+	fs.mutex.Unlock()
+	
+	if cancel != nil {
+		cancel()
+	}
+	if done != nil {
+		<-done
+	}
+}
+
 // rotateSegmentIfNeeded creates a new segment if none exists
 func (fs *FileStorageExtension) rotateSegmentIfNeeded() error {
 	if fs.currentSegment == nil {
@@ -286,62 +582,47 @@ func (fs *FileStorageExtension) rotateSegment() error {
 		}
 	}
 	
-	// Create a new segment file
+	// Create a new segment file, without clobbering a segment created in the
+	// same second, e.g. by a collector that just crashed
 	timestamp := time.Now().UTC().Format("20060102T150405Z")
 	segmentPath := filepath.Join(fs.config.Directory, fmt.Sprintf("segment_%s.dlq", timestamp))
 	
-	file, err := os.Create(segmentPath)
+	file, err := os.OpenFile(segmentPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	for n := 1; os.IsExist(err); n++ {
+		segmentPath = filepath.Join(fs.config.Directory, fmt.Sprintf("segment_%s_%d.dlq", timestamp, n))
+		file, err = os.OpenFile(segmentPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to create segment file: %v", err)
 	}
 	
 	// Write placeholder header (will be updated when segment is finalized)
-	placeholder := make([]byte, headerSize)
-	copy(placeholder, magicBytes)
-	if _, err := file.Write(placeholder); err != nil {
+	if _, err := file.Write(placeholderHeader(currentFormat)); err != nil {
 		file.Close()
 		return fmt.Errorf("failed to write header placeholder: %v", err)
 	}
 	
 	// Reset state for new segment
+	fs.usage[segmentPath] = &segmentUsage{size: int64(headerSize), priority: make(map[uint8]int64)}
+	fs.totalBytes += int64(headerSize)
 	fs.currentSegment = file
 	fs.currentSize = int64(headerSize)
 	fs.currentItemCount = 0
+	fs.currentIndex = newSegmentIndex(filepath.Base(segmentPath))
 	fs.hasher = sha256.New()
 	
 	return nil
 }
 
-// finalizeSegment updates the segment header with final hash and count
+// finalizeSegment updates the segment header with final hash and count, and
+// writes the segment index
 func (fs *FileStorageExtension) finalizeSegment() error {
-	// Get current hash
-	hash := fs.hasher.Sum(nil)
-	
-	// Seek to start of file
-	if _, err := fs.currentSegment.Seek(0, io.SeekStart); err != nil {
-		return fmt.Errorf("failed to seek to start: %v", err)
+	if err := writeSegmentHeader(fs.currentSegment, currentFormat, fs.currentItemCount, fs.hasher.Sum(nil)); err != nil {
+		return err
 	}
 	
-	// Write magic bytes
-	if _, err := fs.currentSegment.Write([]byte(magicBytes)); err != nil {
-		return fmt.Errorf("failed to write magic bytes: %v", err)
-	}
-	
-	// Write item count
-	countBytes := make([]byte, 8)
-	binary.BigEndian.PutUint64(countBytes, uint64(fs.currentItemCount))
-	if _, err := fs.currentSegment.Write(countBytes); err != nil {
-		return fmt.Errorf("failed to write item count: %v", err)
-	}
-	
-	// Write hash (truncate if needed to fit header size)
-	hashSize := headerSize - len(magicBytes) - len(countBytes)
-	if _, err := fs.currentSegment.Write(hash[:hashSize]); err != nil {
-		return fmt.Errorf("failed to write hash: %v", err)
-	}
-	
-	// Sync to disk
-	return fs.currentSegment.Sync()
+	fs.writeSegmentIndex(fs.currentSegment.Name(), fs.currentIndex)
+	return nil
 }
 
 // listSegments returns a list of segment files in the storage directory
@@ -385,113 +666,164 @@ func (fs *FileStorageExtension) verifySegments() {
 	}
 	
 	for _, segmentPath := range segments {
-		// Skip current active segment
-		if fs.currentSegment != nil {
-			currentPath, err := filepath.Abs(fs.currentSegment.Name())
-			if err == nil {
-				absPath, err := filepath.Abs(segmentPath)
-				if err == nil && currentPath == absPath {
-					continue
-				}
-			}
+		// Skip current active segment, and the one replay is reading, which
+		// quarantining would pull out from under the cursor
+		fs.mutex.Lock()
+		skip := fs.isCurrentSegment(segmentPath) || fs.isReplaying(segmentPath)
+		fs.mutex.Unlock()
+		if skip {
+			continue
 		}
 		
 		// Verify this segment
-		if err := fs.verifySegment(segmentPath); err != nil {
+		damaged, err := fs.verifySegment(segmentPath)
+		if damaged > 0 {
+			fs.logger.Warn("Segment has damaged items, which replay will skip",
+				zap.String("segment", segmentPath),
+				zap.Int64("damaged_items", damaged))
+		}
+		if err != nil {
 			fs.logger.Error("Segment verification failed", 
 				zap.String("segment", segmentPath),
 				zap.Error(err))
 			fs.corruptedTotal.Inc()
 			
-			// TODO: Move corrupted file to quarantine directory
+			if err := fs.quarantineSegment(segmentPath, err); err != nil {
+				fs.logger.Error("Failed to quarantine segment",
+					zap.String("segment", segmentPath),
+					zap.Error(err))
+			}
 		}
 	}
 }
 
-// verifySegment checks a single segment for corruption
-func (fs *FileStorageExtension) verifySegment(path string) error {
+// verifySegment checks a single segment for corruption. Damaged items of an
+// NRDQv2 segment are skipped by readers, so they are counted rather than
+// failing the segment. As they may hide how many items there were, the count
+// and hash are only checked when there are none.
+func (fs *FileStorageExtension) verifySegment(path string) (int64, error) {
 	file, err := os.Open(path)
 	if err != nil {
-		return fmt.Errorf("failed to open segment: %v", err)
+		return 0, fmt.Errorf("failed to open segment: %v", err)
 	}
 	defer file.Close()
 	
 	// Read header
-	header := make([]byte, headerSize)
-	if _, err := io.ReadFull(file, header); err != nil {
-		return fmt.Errorf("failed to read header: %v", err)
+	format, itemCount, storedHash, err := readHeader(file)
+	if err != nil {
+		return 0, err
 	}
 	
-	// Verify magic bytes
-	if string(header[:len(magicBytes)]) != magicBytes {
-		return errors.New("invalid magic bytes")
+	// Calculate hash of data, over the items as StoreItem hashed them
+	hasher := sha256.New()
+	reader, err := newSegmentReader(file, format, int64(headerSize))
+	if err != nil {
+		return 0, err
+	}
+	var count uint64
+	var damaged int64
+	for {
+		rec, _, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+		if err == errRecordChecksum {
+			damaged++
+			continue
+		}
+		if err != nil {
+			return damaged, fmt.Errorf("failed to read item %d: %v", count, err)
+		}
+		hasher.Write(rec.data)
+		count++
+	}
+	if damaged > 0 {
+		return damaged, nil
 	}
 	
-	// Get item count
-	itemCount := binary.BigEndian.Uint64(header[len(magicBytes):len(magicBytes)+8])
-	
-	// Get stored hash
-	storedHash := header[len(magicBytes)+8:]
-	
-	// Calculate hash of data
-	hasher := sha256.New()
-	if _, err := io.Copy(hasher, file); err != nil {
-		return fmt.Errorf("failed to hash data: %v", err)
+	if count != itemCount {
+		return 0, fmt.Errorf("item count mismatch: header has %d, segment has %d", itemCount, count)
 	}
 	
 	calculatedHash := hasher.Sum(nil)
 	
 	// Compare hashes (only the stored portion)
 	if !bytes.Equal(calculatedHash[:len(storedHash)], storedHash) {
-		return errors.New("hash verification failed")
+		return 0, errors.New("hash verification failed")
 	}
 	
-	return nil
+	return 0, nil
 }
 
 // replayLoop processes segments for replay with rate limiting
-func (fs *FileStorageExtension) replayLoop(callback func([]byte) error) {
-	// Set up rate limiter using token bucket
-	bytesPerToken := int64(fs.config.MaxSegmentMiB * 1024 * 1024 / 100) // ~1% of segment size per token
-	if bytesPerToken < 4096 {
-		bytesPerToken = 4096 // Minimum 4 KiB per token
+func (fs *FileStorageExtension) replayLoop(ctx context.Context, callback func([]byte) error) {
+	// Set up rate limiter using token bucket, the rate following what the
+	// callbacks report when adaptive
+	rate := newReplayRate(fs.config.Replay)
+	deliver := func(item []byte) error {
+		start := time.Now()
+		err := callback(item)
+		rate.observe(time.Since(start), err)
+		return err
 	}
+	burstBytes := int64(fs.config.Replay.BurstMiB * 1024 * 1024)
 	
 	availableBytes := int64(0)
 	tokenTicker := time.NewTicker(replayTokenInterval)
 	defer tokenTicker.Stop()
 	
-	// Calculate bytes per token interval
-	bytesPerInterval := int64(defaultReplayRateMiBps * 1024 * 1024 * 
-		replayTokenInterval.Seconds())
-	
-	// Live vs replay flag (for 1:1 interleaving)
-	processLive := true
-	toggleTicker := time.NewTicker(500 * time.Millisecond)
-	defer toggleTicker.Stop()
+	// Live vs replay flag, alternating within every replay cycle
+	replayWindow, liveWindow := fs.replayWindows()
+	processLive := liveWindow > 0
+	toggleTimer := time.NewTimer(liveWindow)
+	defer toggleTimer.Stop()
+	
+	// backOff leaves the exporter to live traffic for a window
+	backOff := func() {
+		processLive = true
+		if !toggleTimer.Stop() {
+			select {
+			case <-toggleTimer.C:
+			default:
+			}
+		}
+		if liveWindow > minReplayBackoff {
+			toggleTimer.Reset(liveWindow)
+		} else {
+			toggleTimer.Reset(minReplayBackoff)
+		}
+	}
 	
 	// Main replay loop
 	for {
 		select {
-		case <-fs.replayCtx.Done():
+		case <-ctx.Done():
 			// Replay was cancelled
 			fs.mutex.Lock()
 			fs.replayActive = false
 			fs.replayQueue = nil
 			fs.mutex.Unlock()
+			fs.flushCursor()
 			return
 			
-		case <-toggleTicker.C:
+		case <-toggleTimer.C:
 			// Toggle between live and replay
-			processLive = !processLive
+			processLive = !processLive && liveWindow > 0
 			if processLive {
 				// When processing live, just sleep and continue
+				toggleTimer.Reset(liveWindow)
 				continue
 			}
+			toggleTimer.Reset(replayWindow)
 			
-		case <-tokenTicker.C:
-			// Add token
-			availableBytes += bytesPerInterval
+		case now := <-tokenTicker.C:
+			// Add tokens, saving up at most a burst
+			bytesPerSec := rate.adjust(now)
+			fs.replayRateBytes.Set(bytesPerSec)
+			availableBytes += int64(bytesPerSec * replayTokenInterval.Seconds())
+			if availableBytes > burstBytes {
+				availableBytes = burstBytes
+			}
 			
 			// Skip if we're in live mode
 			if processLive {
@@ -507,38 +839,75 @@ func (fs *FileStorageExtension) replayLoop(callback func([]byte) error) {
 					fs.replayActive = false
 					fs.replayQueue = nil
 					fs.mutex.Unlock()
+					fs.flushCursor()
 					return
 				}
 				
 				segmentPath := fs.replayQueue[0]
+				
+				// Drop segments the index says have expired, unread
+				if usage, ok := fs.usage[segmentPath]; ok && isExpired(usage.newest, fs.expiryCutoff()) && !fs.isCurrentSegment(segmentPath) {
+					fs.replayQueue = fs.replayQueue[1:]
+					if err := fs.removeSegment(segmentPath); err == nil {
+						fs.expiredRecords.WithLabelValues(expireDeleted).Add(float64(usage.items))
+					}
+					fs.mutex.Unlock()
+					continue
+				}
+				
+				segment := filepath.Base(segmentPath)
+				offset := fs.cursor.offsetIn(segment)
+				current := fs.isCurrentSegment(segmentPath)
 				fs.mutex.Unlock()
 				
 				// Process some items from this segment
-				processedBytes, done, err := fs.processSomeItems(segmentPath, availableBytes, callback)
-				if err != nil {
-					fs.logger.Error("Error processing segment", 
+				processedBytes, newOffset, done, err := fs.processSomeItems(segmentPath, offset, availableBytes, deliver)
+				if newOffset > offset {
+					fs.advanceCursor(segment, newOffset)
+				}
+				if errors.Is(err, errReplayCallback) {
+					// Keep the cursor on the rejected item and retry it
+					// after the next live window
+					fs.logger.Warn("Replay callback failed, backing off",
 						zap.String("segment", segmentPath),
 						zap.Error(err))
-					
-					// Move to next segment
-					fs.mutex.Lock()
-					if len(fs.replayQueue) > 0 {
-						fs.replayQueue = fs.replayQueue[1:]
+					backOff()
+					break
+				}
+				if err != nil {
+					if !fs.skipUnreadableSegment(segmentPath, current, err) {
+						// Keep the cursor where reading stopped and retry
+						// after the next live window
+						backOff()
 					}
-					fs.mutex.Unlock()
 					break
 				}
 				
 				// Update available bytes
 				availableBytes -= processedBytes
 				
-				// If segment is done, move to next
+				// If segment is done, reclaim it and move to next
 				if done {
+					// Items may still be appended to the segment being
+					// written, so only a segment that was finalized when
+					// reading started counts as replayed
 					fs.mutex.Lock()
 					if len(fs.replayQueue) > 0 {
 						fs.replayQueue = fs.replayQueue[1:]
 					}
+					if !current {
+						fs.cursor = fs.cursor.withReplayed(segment)
+						fs.cursorDirty = true
+					}
 					fs.mutex.Unlock()
+					
+					// Save the segment as replayed before releasing it
+					fs.flushCursor()
+					if !current {
+						fs.mutex.Lock()
+						fs.releaseSegment(segmentPath)
+						fs.mutex.Unlock()
+					}
 				}
 				
 				// If we've used all tokens, break
@@ -550,112 +919,275 @@ func (fs *FileStorageExtension) replayLoop(callback func([]byte) error) {
 	}
 }
 
-// processSomeItems replays a batch of items from a segment
-func (fs *FileStorageExtension) processSomeItems(segmentPath string, maxBytes int64, callback func([]byte) error) (int64, bool, error) {
+// skipUnreadableSegment takes a segment replay failed to read out of the
+// replay queue, quarantining it unless it is gone. It returns false when the
+// segment stays queued: a segment that was being written when reading started
+// is never quarantined, as its tail may still have been in flight, and neither is a segment the quarantine
+// failed to move, so replay never skips items it did not deliver.
+func (fs *FileStorageExtension) skipUnreadableSegment(segmentPath string, current bool, cause error) bool {
+	if current {
+		fs.logger.Warn("Failed to read the segment being written, backing off",
+			zap.String("segment", segmentPath),
+			zap.Error(cause))
+		return false
+	}
+	
+	if _, err := os.Stat(segmentPath); !os.IsNotExist(err) {
+		fs.logger.Error("Failed to replay segment, quarantining it",
+			zap.String("segment", segmentPath),
+			zap.Error(cause))
+		fs.corruptedTotal.Inc()
+		if err := fs.quarantineSegment(segmentPath, cause); err != nil {
+			fs.logger.Error("Failed to quarantine segment, backing off",
+				zap.String("segment", segmentPath),
+				zap.Error(err))
+			return false
+		}
+	}
+	
+	fs.mutex.Lock()
+	if len(fs.replayQueue) > 0 && fs.replayQueue[0] == segmentPath {
+		fs.replayQueue = fs.replayQueue[1:]
+	}
+	fs.mutex.Unlock()
+	return true
+}
+
+// processSomeItems replays a batch of items from a segment, starting at an
+// offset. It returns the bytes processed, the offset following the last item
+// delivered and whether the segment is done.
+func (fs *FileStorageExtension) processSomeItems(segmentPath string, offset int64, maxBytes int64, callback func([]byte) error) (int64, int64, bool, error) {
 	// Open the segment file
 	file, err := os.Open(segmentPath)
 	if err != nil {
-		return 0, true, fmt.Errorf("failed to open segment: %v", err)
+		return 0, offset, true, fmt.Errorf("failed to open segment: %v", err)
 	}
 	defer file.Close()
 	
-	// Skip header
-	if _, err := file.Seek(int64(headerSize), io.SeekStart); err != nil {
-		return 0, true, fmt.Errorf("failed to seek past header: %v", err)
+	// Read header
+	format, _, _, err := readHeader(file)
+	if err != nil {
+		return 0, offset, true, err
+	}
+	
+	// Resume after the last item delivered
+	if offset < int64(headerSize) {
+		offset = int64(headerSize)
+	}
+	reader, err := newSegmentReader(file, format, offset)
+	if err != nil {
+		return 0, offset, true, err
 	}
 	
 	// Set up zstd decoder
 	decoder, err := zstd.NewReader(nil)
 	if err != nil {
-		return 0, true, fmt.Errorf("failed to create zstd decoder: %v", err)
+		return 0, offset, true, fmt.Errorf("failed to create zstd decoder: %v", err)
 	}
 	defer decoder.Close()
 	
 	// Process items until we hit the byte limit
+	cutoff := fs.expiryCutoff()
 	var processedBytes int64
 	for processedBytes < maxBytes {
-		// Read item size
-		sizeBytes := make([]byte, 4)
-		if _, err := io.ReadFull(file, sizeBytes); err != nil {
+		// Read item
+		rec, size, err := reader.next()
+		if err == errRecordChecksum {
+			// Skip the damaged item and deliver the rest
+			fs.corruptedItemsTotal.Inc()
+			processedBytes += size
+			offset += size
+			continue
+		}
+		if err != nil {
 			if err == io.EOF {
 				// End of file, segment is done
-				return processedBytes, true, nil
+				return processedBytes, offset, true, nil
 			}
-			return processedBytes, false, fmt.Errorf("failed to read item size: %v", err)
+			return processedBytes, offset, false, fmt.Errorf("failed to read item: %v", err)
 		}
 		
-		itemSize := binary.BigEndian.Uint32(sizeBytes)
-		
-		// Read item data
-		compressedData := make([]byte, itemSize)
-		if _, err := io.ReadFull(file, compressedData); err != nil {
-			return processedBytes, false, fmt.Errorf("failed to read item data: %v", err)
+		// Skip items past max_age
+		if isExpired(rec.storedAt, cutoff) {
+			fs.expiredRecords.WithLabelValues(expireSkipped).Inc()
+			processedBytes += size
+			offset += size
+			continue
 		}
 		
 		// Decompress
-		data, err := decoder.DecodeAll(compressedData, nil)
+		data, err := decoder.DecodeAll(rec.data, nil)
 		if err != nil {
-			return processedBytes, false, fmt.Errorf("failed to decompress item: %v", err)
+			return processedBytes, offset, false, fmt.Errorf("failed to decompress item: %v", err)
 		}
 		
 		// Process the item
 		if err := callback(data); err != nil {
-			return processedBytes, false, fmt.Errorf("callback failed: %v", err)
+			return processedBytes, offset, false, fmt.Errorf("%w: %v", errReplayCallback, err)
 		}
 		
 		// Update bytes processed
-		processedBytes += int64(len(sizeBytes) + len(compressedData))
-		
-		// Stop if we've hit the limit
-		if processedBytes >= maxBytes {
-			// Save position for next call
-			return processedBytes, false, nil
-		}
+		processedBytes += size
+		offset += size
 	}
 	
-	return processedBytes, false, nil
+	// Stopped at the byte limit, the cursor holds the position
+	return processedBytes, offset, false, nil
 }
 
 // updateMetrics updates all DLQ metrics
 func (fs *FileStorageExtension) updateMetrics() {
-	// Get all segments
-	segments, err := fs.listSegments()
-	if err != nil {
-		fs.logger.Error("Failed to list segments for metrics", zap.Error(err))
-		return
-	}
-	
-	// Calculate total size
-	var totalSize int64
-	var oldestTime time.Time
-	
-	for _, segment := range segments {
-		info, err := os.Stat(segment)
-		if err != nil {
-			continue
-		}
-		
-		totalSize += info.Size()
-		
-		// Track oldest segment time
-		if oldestTime.IsZero() || info.ModTime().Before(oldestTime) {
-			oldestTime = info.ModTime()
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.updateMetricsLocked()
+}
+
+// updateMetricsLocked updates all DLQ metrics from the segment usage, the
+// age of the oldest item coming from the segment indexes. Callers must hold
+// the mutex.
+func (fs *FileStorageExtension) updateMetricsLocked() {
+	var oldest int64
+	for _, usage := range fs.usage {
+		if usage.items > 0 && (oldest == 0 || usage.oldest < oldest) {
+			oldest = usage.oldest
 		}
 	}
 	
 	// Update metrics
-	maxCapacity := int64(fs.config.MaxSegmentMiB * 1024 * 1024 * 100) // Assume max 100 segments
-	fs.utilizationRatio.Set(float64(totalSize) / float64(maxCapacity))
+	fs.utilizationRatio.Set(float64(fs.usedBytes()) / float64(fs.config.MaxTotalBytes))
 	
-	if !oldestTime.IsZero() {
-		fs.oldestAgeSeconds.Set(float64(time.Since(oldestTime).Seconds()))
+	if oldest != 0 {
+		fs.oldestAgeSeconds.Set(time.Since(time.Unix(0, oldest)).Seconds())
 	} else {
 		fs.oldestAgeSeconds.Set(0)
 	}
 }
 
+// GetClient opens the key-value storage of one component, kept in its own
+// directory of segments next to the DLQ
+func (fs *FileStorageExtension) GetClient(ctx context.Context, kind component.Kind, id component.ID, storageName string) (storage.Client, error) {
+	name := clientName(kind, id, storageName)
+	
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	
+	if _, ok := fs.clients[name]; ok {
+		return nil, fmt.Errorf("storage client %q is already open", name)
+	}
+	
+	dir := filepath.Join(fs.config.Directory, clientsDirectory, name)
+	client, err := newFileStorageClient(name, dir, int64(fs.config.MaxSegmentMiB*1024*1024), fs.compressor, &fs.storageBytes, fs.logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open storage client %q: %v", name, err)
+	}
+	client.onClose = func() {
+		fs.mutex.Lock()
+		defer fs.mutex.Unlock()
+		delete(fs.clients, name)
+	}
+	fs.clients[name] = client
+	
+	return client, nil
+}
+
 // NewFactory creates a factory for File Storage extension
 func NewFactory() extension.Factory {
-	// This would be implemented to register the extension
-	return nil
+	return extension.NewFactory(
+		"file_storage",
+		createDefaultConfig,
+		createExtension,
+		component.StabilityLevelDevelopment,
+	)
+}
+
+// createDefaultConfig creates the default configuration for the extension
+func createDefaultConfig() component.Config {
+	return &FileStorageConfig{
+		Directory:            defaultDirectory,
+		MaxSegmentMiB:        defaultMaxSize / (1024 * 1024),
+		VerificationInterval: defaultVerificationInterval,
+		MaxTotalBytes:        defaultMaxTotalBytes,
+		OverflowPolicy:       defaultOverflowPolicy,
+		Replay: ReplayConfig{
+			RateMiBps:       defaultReplayRateMiBps,
+			BurstMiB:        defaultReplayBurstMiB,
+			InterleaveRatio: defaultReplayInterleaveRatio,
+			Adaptive: AdaptiveReplayConfig{
+				MinRateMiBps:  defaultReplayMinRateMiBps,
+				MaxRateMiBps:  defaultReplayMaxRateMiBps,
+				LatencyFactor: defaultReplayLatencyFactor,
+			},
+		},
+	}
+}
+
+// createExtension creates the file storage extension based on the config
+func createExtension(
+	ctx context.Context,
+	set extension.CreateSettings,
+	cfg component.Config,
+) (extension.Extension, error) {
+	return NewFileStorage(cfg.(*FileStorageConfig), set.Logger)
+}
+
+var (
+	_ storage.Extension         = (*FileStorageExtension)(nil)
+	_ component.ConfigValidator = (*FileStorageConfig)(nil)
+)
+
+// Validate validates the extension configuration
+func (cfg *FileStorageConfig) Validate() error {
+	var errs []error
+	
+	if cfg.Directory == "" {
+		errs = append(errs, errors.New("directory must be specified"))
+	}
+	if cfg.MaxSegmentMiB <= 0 {
+		errs = append(errs, fmt.Errorf("max_segment_mib must be positive, got %d", cfg.MaxSegmentMiB))
+	}
+	if cfg.VerificationInterval <= 0 {
+		errs = append(errs, fmt.Errorf("verification_interval must be positive, got %v", cfg.VerificationInterval))
+	}
+	if cfg.QuarantineDirectory != "" && filepath.Clean(cfg.QuarantineDirectory) == filepath.Clean(cfg.Directory) {
+		errs = append(errs, errors.New("quarantine_directory must differ from directory"))
+	}
+	if cfg.ArchiveDirectory != "" && filepath.Clean(cfg.ArchiveDirectory) == filepath.Clean(cfg.Directory) {
+		errs = append(errs, errors.New("archive_directory must differ from directory"))
+	}
+	if cfg.MaxAge < 0 {
+		errs = append(errs, fmt.Errorf("max_age must not be negative, got %v", cfg.MaxAge))
+	}
+	if cfg.MaxTotalBytes < 2*int64(cfg.MaxSegmentMiB)*1024*1024 {
+		errs = append(errs, fmt.Errorf("max_total_bytes must be at least twice the segment size, got %d", cfg.MaxTotalBytes))
+	}
+	if cfg.Replay.RateMiBps <= 0 {
+		errs = append(errs, fmt.Errorf("replay::rate_mib_per_sec must be positive, got %v", cfg.Replay.RateMiBps))
+	}
+	if cfg.Replay.BurstMiB <= 0 {
+		errs = append(errs, fmt.Errorf("replay::burst_mib must be positive, got %v", cfg.Replay.BurstMiB))
+	}
+	if cfg.Replay.InterleaveRatio <= 0 || cfg.Replay.InterleaveRatio > 1 {
+		errs = append(errs, fmt.Errorf("replay::interleave_ratio must be in (0, 1], got %v", cfg.Replay.InterleaveRatio))
+	}
+	if adaptive := cfg.Replay.Adaptive; adaptive.Enabled {
+		if adaptive.MinRateMiBps <= 0 {
+			errs = append(errs, fmt.Errorf("replay::adaptive::min_rate_mib_per_sec must be positive, got %v", adaptive.MinRateMiBps))
+		}
+		if adaptive.MaxRateMiBps < adaptive.MinRateMiBps {
+			errs = append(errs, fmt.Errorf("replay::adaptive::max_rate_mib_per_sec (%v) is below min_rate_mib_per_sec (%v)", adaptive.MaxRateMiBps, adaptive.MinRateMiBps))
+		} else if cfg.Replay.RateMiBps < adaptive.MinRateMiBps || cfg.Replay.RateMiBps > adaptive.MaxRateMiBps {
+			errs = append(errs, fmt.Errorf("replay::rate_mib_per_sec (%v) must be within the adaptive rate bounds", cfg.Replay.RateMiBps))
+		}
+		if adaptive.LatencyFactor <= 1 {
+			errs = append(errs, fmt.Errorf("replay::adaptive::latency_factor must be greater than 1, got %v", adaptive.LatencyFactor))
+		}
+	}
+	switch cfg.OverflowPolicy {
+	case overflowReject, overflowDropOldest, overflowDropLowestPriority:
+	default:
+		errs = append(errs, fmt.Errorf("overflow_policy must be one of %s, %s or %s, got %q",
+			overflowReject, overflowDropOldest, overflowDropLowestPriority, cfg.OverflowPolicy))
+	}
+	
+	return errors.Join(errs...)
 }
@@ -0,0 +1,159 @@
+package dlq
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// newTestStorage starts a DLQ in a temporary directory, stopping it when the
+// test ends
+func newTestStorage(t *testing.T, configure func(cfg *FileStorageConfig)) *FileStorageExtension {
+	t.Helper()
+	cfg := createDefaultConfig().(*FileStorageConfig)
+	cfg.Directory = t.TempDir()
+	cfg.QuarantineDirectory = filepath.Join(cfg.Directory, "quarantine")
+	if configure != nil {
+		configure(cfg)
+	}
+
+	fs, err := NewFileStorage(cfg, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Start(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := fs.Shutdown(context.Background()); err != nil {
+			t.Error(err)
+		}
+	})
+	return fs
+}
+
+// finalizeTestSegment finalizes the segment being written and returns its
+// path along with the offset of every item it holds
+func finalizeTestSegment(t *testing.T, fs *FileStorageExtension) (string, []int64) {
+	t.Helper()
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	path := fs.currentSegment.Name()
+	offsets := make([]int64, 0, len(fs.currentIndex.Records))
+	for _, entry := range fs.currentIndex.Records {
+		offsets = append(offsets, entry.Offset)
+	}
+	if err := fs.rotateSegment(); err != nil {
+		t.Fatal(err)
+	}
+	return path, offsets
+}
+
+// readSegmentRecords returns the intact items of a segment
+func readSegmentRecords(t *testing.T, path string) []record {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	format, _, _, err := readHeader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := newSegmentReader(file, format, int64(headerSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var records []record
+	for {
+		rec, _, err := reader.next()
+		if err == io.EOF {
+			return records
+		}
+		if err == errRecordChecksum {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rec)
+	}
+}
+
+func TestBackgroundLoopLifetime(t *testing.T) {
+	tests := []struct {
+		name            string
+		cancelStart     bool
+		shutdown        bool
+		wantQuarantined bool
+	}{
+		{name: "running", wantQuarantined: true},
+		{name: "start context cancelled", cancelStart: true, wantQuarantined: true},
+		{name: "shut down", shutdown: true, wantQuarantined: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := createDefaultConfig().(*FileStorageConfig)
+			cfg.Directory = t.TempDir()
+			cfg.QuarantineDirectory = filepath.Join(cfg.Directory, "quarantine")
+			cfg.VerificationInterval = 10 * time.Millisecond
+			fs, err := NewFileStorage(cfg, zap.NewNop())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if err := fs.Start(ctx, nil); err != nil {
+				t.Fatal(err)
+			}
+			defer fs.Shutdown(context.Background())
+
+			if err := fs.StoreItem([]byte("item")); err != nil {
+				t.Fatal(err)
+			}
+			path, _ := finalizeTestSegment(t, fs)
+
+			if tt.cancelStart {
+				cancel()
+			}
+			if tt.shutdown {
+				// Shutdown returns once the loops stopped, so none of
+				// them can get to the segment damaged afterwards
+				if err := fs.Shutdown(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Damage the header, which the verification loop quarantines
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data[0] ^= 0xff
+			if err := os.WriteFile(path, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			target := filepath.Join(cfg.QuarantineDirectory, filepath.Base(path))
+			quarantined := false
+			for deadline := time.Now().Add(time.Second); time.Now().Before(deadline) && !quarantined; time.Sleep(10 * time.Millisecond) {
+				_, err := os.Stat(target)
+				quarantined = err == nil
+			}
+			if quarantined != tt.wantQuarantined {
+				t.Errorf("quarantined = %v, want %v", quarantined, tt.wantQuarantined)
+			}
+		})
+	}
+}
@@ -0,0 +1,338 @@
+package dlq
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// Every segment starts with a 32 byte header: magic bytes naming the format
+// version, the item count, and the first 18 bytes of the SHA-256 of the item
+// payloads. The header is written when the segment is finalized.
+//
+// NRDQv1 items are [length u32][payload]. A single damaged byte fails the
+// segment hash and condemns the whole segment.
+//
+// NRDQv2 items are [marker u32][length u32][crc32c u32][priority u8]
+// [stored_at i64][payload]. The CRC32C covers everything but itself, so
+// readers can skip a damaged item, count it, and deliver the rest. The
+// constant marker lets them find the next item when the damage hit a length.
+// Priority is the item's priority class, so capacity enforcement can drop the
+// lowest priority items first, and stored_at is when the item entered the DLQ
+// in Unix nanoseconds, so retention can expire items by age. New segments are
+// written as NRDQv2; NRDQv1 segments remain readable, their items having
+// priority 0 and no timestamp.
+
+const (
+	magicBytesV1 = "NRDQv1"
+	magicBytesV2 = "NRDQv2"
+	headerSize   = 32 // Magic(6) + ItemCount(8) + SHA256(32-6-8=18 remaining)
+
+	// recordMarker starts every NRDQv2 item
+	recordMarker uint32 = 0xD1A9C0DE
+)
+
+// segmentFormat is the format version of a segment
+type segmentFormat int
+
+const (
+	formatV1 segmentFormat = 1
+	formatV2 segmentFormat = 2
+
+	// currentFormat is the format new segments are written in
+	currentFormat = formatV2
+)
+
+var (
+	crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+	// errRecordChecksum is returned for an item that is damaged
+	errRecordChecksum = errors.New("item checksum mismatch")
+)
+
+// magic returns the magic bytes of the format
+func (f segmentFormat) magic() string {
+	if f == formatV1 {
+		return magicBytesV1
+	}
+	return magicBytesV2
+}
+
+// recordOverhead returns the bytes an item takes on top of its payload
+func (f segmentFormat) recordOverhead() int64 {
+	if f == formatV1 {
+		return 4
+	}
+	return 21
+}
+
+// record is one item of a segment
+type record struct {
+	data     []byte
+	priority uint8
+	storedAt int64 // Unix nanoseconds, 0 if the format has no timestamp
+}
+
+// size returns the bytes the item takes in a segment of a format
+func (r record) size(format segmentFormat) int64 {
+	return format.recordOverhead() + int64(len(r.data))
+}
+
+// parseHeader returns the format of a segment header along with its item
+// count and stored hash
+func parseHeader(header []byte) (segmentFormat, uint64, []byte, error) {
+	var format segmentFormat
+	switch string(header[:len(magicBytesV1)]) {
+	case magicBytesV1:
+		format = formatV1
+	case magicBytesV2:
+		format = formatV2
+	default:
+		return 0, 0, nil, errors.New("invalid magic bytes")
+	}
+
+	itemCount := binary.BigEndian.Uint64(header[len(magicBytesV1) : len(magicBytesV1)+8])
+	return format, itemCount, header[len(magicBytesV1)+8:], nil
+}
+
+// readHeader reads and parses the header at the start of a segment
+func readHeader(r io.Reader) (segmentFormat, uint64, []byte, error) {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, 0, nil, fmt.Errorf("failed to read header: %v", err)
+	}
+	return parseHeader(header)
+}
+
+// placeholderHeader returns the header new segments start with
+func placeholderHeader(format segmentFormat) []byte {
+	header := make([]byte, headerSize)
+	copy(header, format.magic())
+	return header
+}
+
+// writeSegmentHeader writes the magic bytes, item count and hash to the
+// start of a segment and syncs it to disk
+func writeSegmentHeader(file *os.File, format segmentFormat, itemCount int64, hash []byte) error {
+	// Seek to start of file
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek to start: %v", err)
+	}
+
+	header := placeholderHeader(format)
+	binary.BigEndian.PutUint64(header[len(magicBytesV1):], uint64(itemCount))
+
+	// Write hash (truncate if needed to fit header size)
+	copy(header[len(magicBytesV1)+8:], hash)
+	if _, err := file.Write(header); err != nil {
+		return fmt.Errorf("failed to write header: %v", err)
+	}
+
+	// Return to the end so later writes append
+	if _, err := file.Seek(0, io.SeekEnd); err != nil {
+		return fmt.Errorf("failed to seek to end: %v", err)
+	}
+
+	// Sync to disk
+	return file.Sync()
+}
+
+// syncDir makes files created, renamed or removed in a directory durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory: %v", err)
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory: %v", err)
+	}
+	return nil
+}
+
+// recordChecksum returns the CRC32C of an NRDQv2 item, over its prefix
+// without the checksum and its payload
+func recordChecksum(prefix, data []byte) uint32 {
+	crc := crc32.Checksum(prefix[:8], crc32cTable)
+	crc = crc32.Update(crc, crc32cTable, prefix[12:])
+	return crc32.Update(crc, crc32cTable, data)
+}
+
+// writeRecord writes an item in the current format and returns the bytes
+// written
+func writeRecord(w io.Writer, rec record) (int64, error) {
+	data := rec.data
+	prefix := make([]byte, currentFormat.recordOverhead())
+	binary.BigEndian.PutUint32(prefix, recordMarker)
+	binary.BigEndian.PutUint32(prefix[4:], uint32(len(data)))
+	prefix[12] = rec.priority
+	binary.BigEndian.PutUint64(prefix[13:], uint64(rec.storedAt))
+	binary.BigEndian.PutUint32(prefix[8:], recordChecksum(prefix, data))
+
+	if _, err := w.Write(prefix); err != nil {
+		return 0, fmt.Errorf("failed to write item size: %v", err)
+	}
+
+	if _, err := w.Write(data); err != nil {
+		return int64(len(prefix)), fmt.Errorf("failed to write item data: %v", err)
+	}
+
+	return int64(len(prefix) + len(data)), nil
+}
+
+// readRecord reads the item at the start of r. It returns io.EOF at the end
+// of a segment, io.ErrUnexpectedEOF for an item cut short, and
+// errRecordChecksum for an item that is damaged, in which case the bytes
+// consumed say nothing about where the next item starts.
+func readRecord(r io.Reader, format segmentFormat) (record, error) {
+	prefix := make([]byte, format.recordOverhead())
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return record{}, err
+	}
+
+	lengthAt := 0
+	if format >= formatV2 {
+		if binary.BigEndian.Uint32(prefix) != recordMarker {
+			return record{}, errRecordChecksum
+		}
+		lengthAt = 4
+	}
+
+	// Read through a limit, so a damaged length cannot allocate more than
+	// the segment holds
+	size := int64(binary.BigEndian.Uint32(prefix[lengthAt:]))
+	data, err := io.ReadAll(io.LimitReader(r, size))
+	if err != nil {
+		return record{}, err
+	}
+	if int64(len(data)) < size {
+		return record{}, io.ErrUnexpectedEOF
+	}
+
+	if format >= formatV2 && binary.BigEndian.Uint32(prefix[8:]) != recordChecksum(prefix, data) {
+		return record{}, errRecordChecksum
+	}
+
+	rec := parsePrefix(prefix, format)
+	rec.data = data
+	return rec, nil
+}
+
+// parsePrefix returns the fields of an item prefix, without the payload
+func parsePrefix(prefix []byte, format segmentFormat) record {
+	var rec record
+	if format >= formatV2 {
+		rec.priority = prefix[12]
+		rec.storedAt = int64(binary.BigEndian.Uint64(prefix[13:]))
+	}
+	return rec
+}
+
+// segmentReader reads the items of a segment in order. After a damaged
+// NRDQv2 item it resyncs at the next marker starting an intact item, so
+// damage costs only the items it hit rather than the rest of the segment.
+type segmentReader struct {
+	file   io.ReadSeeker
+	reader *bufio.Reader
+	format segmentFormat
+	offset int64
+}
+
+// newSegmentReader reads the items of a segment from an offset
+func newSegmentReader(file io.ReadSeeker, format segmentFormat, offset int64) (*segmentReader, error) {
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to seek to offset %d: %v", offset, err)
+	}
+	return &segmentReader{
+		file:   file,
+		reader: bufio.NewReader(file),
+		format: format,
+		offset: offset,
+	}, nil
+}
+
+// next returns the next item along with the bytes it takes. It returns
+// io.EOF at the end of the segment and io.ErrUnexpectedEOF for a torn tail,
+// an item cut short with no intact item after it. A damaged item is reported
+// with errRecordChecksum and a size reaching up to the next intact item, or
+// to the end of the segment if there is none.
+func (r *segmentReader) next() (record, int64, error) {
+	start := r.offset
+	rec, err := readRecord(r.reader, r.format)
+	if err == nil {
+		size := rec.size(r.format)
+		r.offset += size
+		return rec, size, nil
+	}
+	if r.format == formatV1 || (err != errRecordChecksum && err != io.ErrUnexpectedEOF) {
+		return record{}, 0, err
+	}
+
+	next, found, resyncErr := r.resync(start + 1)
+	if resyncErr != nil {
+		return record{}, 0, resyncErr
+	}
+	if !found && err == io.ErrUnexpectedEOF {
+		// Nothing intact follows, so this is where writing stopped
+		return record{}, 0, err
+	}
+	r.offset = next
+	return record{}, next - start, errRecordChecksum
+}
+
+// resync positions the reader at the first intact item at or after an
+// offset. It reports whether there is one, and otherwise positions the reader
+// at the end of the segment.
+func (r *segmentReader) resync(from int64) (int64, bool, error) {
+	for {
+		if _, err := r.file.Seek(from, io.SeekStart); err != nil {
+			return 0, false, fmt.Errorf("failed to seek to offset %d: %v", from, err)
+		}
+		r.reader.Reset(r.file)
+
+		skipped, err := skipToMarker(r.reader)
+		candidate := from + skipped
+		if err == io.EOF {
+			return candidate, false, nil
+		}
+		if err != nil {
+			return 0, false, err
+		}
+
+		if _, err := readRecord(r.reader, r.format); err == nil {
+			if _, err := r.file.Seek(candidate, io.SeekStart); err != nil {
+				return 0, false, fmt.Errorf("failed to seek to offset %d: %v", candidate, err)
+			}
+			r.reader.Reset(r.file)
+			return candidate, true, nil
+		}
+		from = candidate + 1
+	}
+}
+
+// skipToMarker discards bytes up to the next item marker and returns how
+// many it discarded. At the end of the segment it returns io.EOF along with
+// the bytes that were left.
+func skipToMarker(r *bufio.Reader) (int64, error) {
+	var skipped int64
+	for {
+		b, err := r.Peek(4)
+		if err == io.EOF {
+			n, _ := r.Discard(len(b))
+			return skipped + int64(n), io.EOF
+		}
+		if err != nil {
+			return skipped, err
+		}
+		if binary.BigEndian.Uint32(b) == recordMarker {
+			return skipped, nil
+		}
+		r.Discard(1)
+		skipped++
+	}
+}
@@ -0,0 +1,247 @@
+package dlq
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestSegment writes a segment holding one item per payload and returns
+// its path along with the offset of every item. Unless finalize is set, the
+// segment keeps its placeholder header, as after a crash.
+func writeTestSegment(t *testing.T, payloads [][]byte, finalize bool) (string, []int64) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "segment_1.dlq")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(placeholderHeader(currentFormat)); err != nil {
+		t.Fatal(err)
+	}
+	offsets := make([]int64, 0, len(payloads))
+	offset := int64(headerSize)
+	for i, payload := range payloads {
+		offsets = append(offsets, offset)
+		written, err := writeRecord(file, record{data: payload, priority: uint8(i), storedAt: int64(1000 + i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		offset += written
+	}
+	if !finalize {
+		return path, offsets
+	}
+	hasher := sha256.New()
+	for _, payload := range payloads {
+		hasher.Write(payload)
+	}
+	if err := writeSegmentHeader(file, currentFormat, int64(len(payloads)), hasher.Sum(nil)); err != nil {
+		t.Fatal(err)
+	}
+	return path, offsets
+}
+
+// testPayloads returns n payloads that are told apart by their content
+func testPayloads(n int) [][]byte {
+	payloads := make([][]byte, n)
+	for i := range payloads {
+		payloads[i] = bytes.Repeat([]byte(fmt.Sprintf("item-%d;", i)), 8)
+	}
+	return payloads
+}
+
+// readTestSegment reads a segment to its end, returning the indexes of the
+// items read, how many damaged items were skipped, the bytes all items took
+// and the error reading stopped at
+func readTestSegment(t *testing.T, path string, payloads [][]byte) ([]int, int, int64, error) {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	format, _, _, err := readHeader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := newSegmentReader(file, format, int64(headerSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var items []int
+	var damaged int
+	var total int64
+	for {
+		rec, size, err := reader.next()
+		if err == errRecordChecksum {
+			damaged++
+			total += size
+			continue
+		}
+		if err != nil {
+			return items, damaged, total, err
+		}
+		total += size
+
+		index := -1
+		for i, payload := range payloads {
+			if bytes.Equal(rec.data, payload) {
+				index = i
+			}
+		}
+		if index < 0 {
+			t.Fatalf("read an item matching no payload: %q", rec.data)
+		}
+		if rec.priority != uint8(index) || rec.storedAt != int64(1000+index) {
+			t.Errorf("item %d read with priority %d and stored_at %d", index, rec.priority, rec.storedAt)
+		}
+		items = append(items, index)
+	}
+}
+
+func TestSegmentReader(t *testing.T) {
+	// Damage is applied to the file holding five items; offsets[i] is where
+	// item i starts
+	tests := []struct {
+		name        string
+		damage      func(data []byte, offsets []int64) []byte
+		wantItems   []int
+		wantDamaged int
+		wantErr     error
+	}{
+		{
+			name:      "intact",
+			damage:    func(data []byte, _ []int64) []byte { return data },
+			wantItems: []int{0, 1, 2, 3, 4},
+			wantErr:   io.EOF,
+		},
+		{
+			name: "flipped payload byte mid-segment",
+			damage: func(data []byte, offsets []int64) []byte {
+				data[offsets[2]+30] ^= 0xff
+				return data
+			},
+			wantItems:   []int{0, 1, 3, 4},
+			wantDamaged: 1,
+			wantErr:     io.EOF,
+		},
+		{
+			name: "length grown past the segment end",
+			damage: func(data []byte, offsets []int64) []byte {
+				binary.BigEndian.PutUint32(data[offsets[1]+4:], 1<<30)
+				return data
+			},
+			wantItems:   []int{0, 2, 3, 4},
+			wantDamaged: 1,
+			wantErr:     io.EOF,
+		},
+		{
+			name: "length shrunk into the payload",
+			damage: func(data []byte, offsets []int64) []byte {
+				binary.BigEndian.PutUint32(data[offsets[1]+4:], 3)
+				return data
+			},
+			wantItems:   []int{0, 2, 3, 4},
+			wantDamaged: 1,
+			wantErr:     io.EOF,
+		},
+		{
+			name: "damaged marker",
+			damage: func(data []byte, offsets []int64) []byte {
+				data[offsets[3]] ^= 0xff
+				return data
+			},
+			wantItems:   []int{0, 1, 2, 4},
+			wantDamaged: 1,
+			wantErr:     io.EOF,
+		},
+		{
+			name: "zeroed span across items",
+			damage: func(data []byte, offsets []int64) []byte {
+				for i := offsets[1] + 10; i < offsets[3]+10; i++ {
+					data[i] = 0
+				}
+				return data
+			},
+			wantItems:   []int{0, 4},
+			wantDamaged: 1,
+			wantErr:     io.EOF,
+		},
+		{
+			name: "damaged last item",
+			damage: func(data []byte, offsets []int64) []byte {
+				data[len(data)-1] ^= 0xff
+				return data
+			},
+			wantItems:   []int{0, 1, 2, 3},
+			wantDamaged: 1,
+			wantErr:     io.EOF,
+		},
+		{
+			name: "torn tail in a payload",
+			damage: func(data []byte, offsets []int64) []byte {
+				return data[:offsets[4]+30]
+			},
+			wantItems: []int{0, 1, 2, 3},
+			wantErr:   io.ErrUnexpectedEOF,
+		},
+		{
+			name: "torn tail in a prefix",
+			damage: func(data []byte, offsets []int64) []byte {
+				return data[:offsets[4]+5]
+			},
+			wantItems: []int{0, 1, 2, 3},
+			wantErr:   io.ErrUnexpectedEOF,
+		},
+		{
+			name: "torn tail after damage",
+			damage: func(data []byte, offsets []int64) []byte {
+				data[offsets[1]+30] ^= 0xff
+				return data[:offsets[4]+30]
+			},
+			wantItems:   []int{0, 2, 3},
+			wantDamaged: 1,
+			wantErr:     io.ErrUnexpectedEOF,
+		},
+	}
+
+	payloads := testPayloads(5)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, offsets := writeTestSegment(t, payloads, true)
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data = tt.damage(data, offsets)
+			if err := os.WriteFile(path, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			items, damaged, total, err := readTestSegment(t, path, payloads)
+			if err != tt.wantErr {
+				t.Fatalf("stopped with %v, want %v", err, tt.wantErr)
+			}
+			if fmt.Sprint(items) != fmt.Sprint(tt.wantItems) {
+				t.Errorf("read items %v, want %v", items, tt.wantItems)
+			}
+			if damaged != tt.wantDamaged {
+				t.Errorf("skipped %d damaged items, want %d", damaged, tt.wantDamaged)
+			}
+			// Sizes must add up to the whole segment, so offsets stay valid
+			if err == io.EOF && int64(headerSize)+total != int64(len(data)) {
+				t.Errorf("items took %d bytes of %d", int64(headerSize)+total, len(data))
+			}
+		})
+	}
+}
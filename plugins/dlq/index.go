@@ -0,0 +1,223 @@
+package dlq
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"go.uber.org/zap"
+)
+
+// Every finalized segment gets an index next to it, <segment>.idx, listing
+// where each item starts along with its storage time, signal type, priority
+// class and tenant, and summing them up per segment. Capacity, retention,
+// replay and metrics work from the index instead of reading segments or
+// trusting file mtimes, and what the DLQ holds can be told without
+// decompressing anything.
+//
+// The index of the segment being written is kept in memory and written when
+// the segment is finalized. Segments without an index, or whose index does
+// not match their size, e.g. after a crash, are indexed again by walking
+// their items; signal types and tenants are not in the segment itself, so
+// they are lost for those.
+
+const indexSuffix = ".idx"
+
+// ItemMetadata describes an item stored in the DLQ
+type ItemMetadata struct {
+	// Priority is the priority class, higher values being more important
+	Priority uint8
+
+	// Signal is the signal type, e.g. traces, metrics or logs
+	Signal string
+
+	// Tenant is the tenant the item belongs to
+	Tenant string
+}
+
+// segmentIndex is the index of a segment
+type segmentIndex struct {
+	Segment     string           `json:"segment"`
+	SizeBytes   int64            `json:"size_bytes"`
+	Items       int64            `json:"items"`
+	MinStoredAt int64            `json:"min_stored_at,omitempty"` // Unix nanoseconds
+	MaxStoredAt int64            `json:"max_stored_at,omitempty"` // Unix nanoseconds
+	Priorities  map[uint8]int64  `json:"priorities"`              // items per priority class
+	Signals     map[string]int64 `json:"signals,omitempty"`       // items per signal type
+	Tenants     map[string]int64 `json:"tenants,omitempty"`       // items per tenant
+	Records     []indexRecord    `json:"records"`
+}
+
+// indexRecord is the index entry of an item
+type indexRecord struct {
+	Offset   int64  `json:"offset"`
+	Size     int64  `json:"size"`
+	StoredAt int64  `json:"stored_at,omitempty"`
+	Priority uint8  `json:"priority,omitempty"`
+	Signal   string `json:"signal,omitempty"`
+	Tenant   string `json:"tenant,omitempty"`
+}
+
+// newSegmentIndex returns the empty index of a segment
+func newSegmentIndex(segment string) *segmentIndex {
+	return &segmentIndex{
+		Segment:    segment,
+		SizeBytes:  int64(headerSize),
+		Priorities: make(map[uint8]int64),
+		Signals:    make(map[string]int64),
+		Tenants:    make(map[string]int64),
+	}
+}
+
+// add appends the entry of an item
+func (ix *segmentIndex) add(entry indexRecord) {
+	ix.Records = append(ix.Records, entry)
+	ix.Items++
+	if end := entry.Offset + entry.Size; end > ix.SizeBytes {
+		ix.SizeBytes = end
+	}
+	if entry.StoredAt > 0 {
+		if ix.MinStoredAt == 0 || entry.StoredAt < ix.MinStoredAt {
+			ix.MinStoredAt = entry.StoredAt
+		}
+		if entry.StoredAt > ix.MaxStoredAt {
+			ix.MaxStoredAt = entry.StoredAt
+		}
+	}
+	ix.Priorities[entry.Priority]++
+	if entry.Signal != "" {
+		ix.Signals[entry.Signal]++
+	}
+	if entry.Tenant != "" {
+		ix.Tenants[entry.Tenant]++
+	}
+}
+
+// lookup returns the entries of an index by offset
+func (ix *segmentIndex) lookup() map[int64]indexRecord {
+	entries := make(map[int64]indexRecord, len(ix.Records))
+	for _, entry := range ix.Records {
+		entries[entry.Offset] = entry
+	}
+	return entries
+}
+
+// indexPath returns the path of a segment's index
+func indexPath(segmentPath string) string {
+	return segmentPath + indexSuffix
+}
+
+// loadIndex reads the index of a segment, failing if it does not match the
+// segment's size
+func loadIndex(segmentPath string, size int64) (*segmentIndex, error) {
+	data, err := os.ReadFile(indexPath(segmentPath))
+	if err != nil {
+		return nil, err
+	}
+
+	var ix segmentIndex
+	if err := json.Unmarshal(data, &ix); err != nil {
+		return nil, fmt.Errorf("failed to decode index: %v", err)
+	}
+	if ix.Segment != filepath.Base(segmentPath) || ix.SizeBytes != size {
+		return nil, fmt.Errorf("index of %s with %d bytes does not match segment", ix.Segment, ix.SizeBytes)
+	}
+	if ix.Priorities == nil {
+		ix.Priorities = make(map[uint8]int64)
+	}
+	if ix.Signals == nil {
+		ix.Signals = make(map[string]int64)
+	}
+	if ix.Tenants == nil {
+		ix.Tenants = make(map[string]int64)
+	}
+	return &ix, nil
+}
+
+// scanIndex indexes a segment by walking its items. If the segment cannot be
+// fully walked, the items indexed so far are returned along with the error.
+func scanIndex(segmentPath string) (*segmentIndex, error) {
+	file, err := os.Open(segmentPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open segment: %v", err)
+	}
+	defer file.Close()
+
+	ix := newSegmentIndex(filepath.Base(segmentPath))
+	format, _, _, err := readHeader(file)
+	if err != nil {
+		return ix, err
+	}
+
+	reader, err := newSegmentReader(file, format, int64(headerSize))
+	if err != nil {
+		return ix, err
+	}
+	offset := int64(headerSize)
+	for {
+		rec, size, err := reader.next()
+		if err == io.EOF {
+			return ix, nil
+		}
+		if err == errRecordChecksum {
+			// Damaged items are not indexed, but still take up the segment
+			offset += size
+			ix.SizeBytes = offset
+			continue
+		}
+		if err != nil {
+			return ix, fmt.Errorf("failed to read item: %v", err)
+		}
+		ix.add(indexRecord{
+			Offset:   offset,
+			Size:     size,
+			StoredAt: rec.storedAt,
+			Priority: rec.priority,
+		})
+		offset += size
+	}
+}
+
+// writeIndex atomically replaces the index of a segment
+func writeIndex(segmentPath string, ix *segmentIndex) error {
+	data, err := json.Marshal(ix)
+	if err != nil {
+		return fmt.Errorf("failed to encode index: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(segmentPath), filepath.Base(indexPath(segmentPath))+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create index: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write index: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close index: %v", err)
+	}
+
+	if err := os.Rename(tmp.Name(), indexPath(segmentPath)); err != nil {
+		return fmt.Errorf("failed to replace index: %v", err)
+	}
+	return nil
+}
+
+// writeSegmentIndex writes the index of a segment. A failure is only logged,
+// as the index is rebuilt from the segment when missing.
+func (fs *FileStorageExtension) writeSegmentIndex(segmentPath string, ix *segmentIndex) {
+	if err := writeIndex(segmentPath, ix); err != nil {
+		fs.logger.Warn("Failed to write segment index",
+			zap.String("segment", segmentPath),
+			zap.Error(err))
+	}
+}
+
+// removeIndex deletes the index of a segment, if any
+func removeIndex(segmentPath string) {
+	os.Remove(indexPath(segmentPath))
+}
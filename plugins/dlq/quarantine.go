@@ -0,0 +1,207 @@
+package dlq
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Segments failing verification are moved to the quarantine directory, out
+// of reach of replay and utilization, along with their index and a sidecar
+// JSON file describing the failure. With salvage enabled, the items of a
+// quarantined segment that can still be read are stored back into the DLQ
+// first, keeping their priority and storage time along with the metadata the
+// index has for them. Items replay already delivered are not salvaged.
+
+// quarantineReport is the sidecar written next to a quarantined segment
+type quarantineReport struct {
+	Segment       string    `json:"segment"`
+	Error         string    `json:"error"`
+	QuarantinedAt time.Time `json:"quarantined_at"`
+	SizeBytes     int64     `json:"size_bytes"`
+	SalvagedItems int64     `json:"salvaged_items"`
+	SkippedItems  int64     `json:"skipped_items"`
+	ReplayedItems int64     `json:"replayed_items"`
+	SalvageError  string    `json:"salvage_error,omitempty"`
+}
+
+// quarantineSegment moves a corrupted segment to the quarantine directory
+func (fs *FileStorageExtension) quarantineSegment(path string, cause error) error {
+	target := filepath.Join(fs.config.QuarantineDirectory, filepath.Base(path))
+	if err := moveFile(path, target); err != nil {
+		return fmt.Errorf("failed to move segment: %v", err)
+	}
+	if err := moveFile(indexPath(path), indexPath(target)); err != nil && !os.IsNotExist(err) {
+		removeIndex(path)
+	}
+	fs.mutex.Lock()
+	fs.forgetSegment(path)
+	fs.mutex.Unlock()
+
+	report := quarantineReport{
+		Segment:       filepath.Base(path),
+		Error:         cause.Error(),
+		QuarantinedAt: time.Now().UTC(),
+	}
+	if info, err := os.Stat(target); err == nil {
+		report.SizeBytes = info.Size()
+	}
+
+	if fs.config.Salvage {
+		salvaged, skipped, replayed, err := fs.salvageSegment(target)
+		report.SalvagedItems = salvaged
+		report.SkippedItems = skipped
+		report.ReplayedItems = replayed
+		if err != nil {
+			report.SalvageError = err.Error()
+		}
+		fs.salvagedTotal.Add(float64(salvaged))
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode quarantine report: %v", err)
+	}
+	if err := os.WriteFile(target+".json", data, 0644); err != nil {
+		return fmt.Errorf("failed to write quarantine report: %v", err)
+	}
+
+	fs.logger.Warn("Quarantined corrupted segment",
+		zap.String("segment", target),
+		zap.Int64("salvaged_items", report.SalvagedItems),
+		zap.Int64("skipped_items", report.SkippedItems))
+	fs.updateMetrics()
+
+	return nil
+}
+
+// salvageSegment stores every item of a quarantined segment that still
+// decompresses, and passes its checksum, back into the DLQ. Items that do not
+// are skipped; a torn tail ends the segment. Items before the replay cursor
+// were already delivered and are only counted. NRDQv1 items carry no storage
+// time, so they count as stored when salvaged.
+func (fs *FileStorageExtension) salvageSegment(path string) (int64, int64, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("failed to open segment: %v", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("failed to stat segment: %v", err)
+	}
+	var entries map[int64]indexRecord
+	if ix, err := loadIndex(path, info.Size()); err == nil {
+		entries = ix.lookup()
+	}
+
+	format, _, _, err := readHeader(file)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	reader, err := newSegmentReader(file, format, int64(headerSize))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("failed to create zstd decoder: %v", err)
+	}
+	defer decoder.Close()
+
+	// Everything before this offset was delivered by replay
+	fs.mutex.Lock()
+	cursor := fs.cursor
+	fs.mutex.Unlock()
+	replayedUpTo := cursor.offsetIn(filepath.Base(path))
+	if cursor.covers(filepath.Base(path)) {
+		replayedUpTo = info.Size()
+	}
+
+	var salvaged, skipped, replayed int64
+	offset := int64(headerSize)
+	for {
+		rec, size, err := reader.next()
+		if err == io.EOF {
+			return salvaged, skipped, replayed, nil
+		}
+		entry := entries[offset]
+		itemOffset := offset
+		offset += size
+		if err == errRecordChecksum {
+			skipped++
+			continue
+		}
+		if err != nil {
+			return salvaged, skipped, replayed, fmt.Errorf("failed to read item: %v", err)
+		}
+		if itemOffset < replayedUpTo {
+			replayed++
+			continue
+		}
+
+		item, err := decoder.DecodeAll(rec.data, nil)
+		if err != nil {
+			skipped++
+			continue
+		}
+		storedAt := rec.storedAt
+		if storedAt == 0 {
+			storedAt = time.Now().UnixNano()
+		}
+		meta := ItemMetadata{Priority: rec.priority, Signal: entry.Signal, Tenant: entry.Tenant}
+		if err := fs.storeItem(item, meta, storedAt); err != nil {
+			return salvaged, skipped, replayed, fmt.Errorf("failed to store salvaged item: %v", err)
+		}
+		salvaged++
+	}
+}
+
+// moveFile renames a file, copying it when the target is on another device
+func moveFile(source, target string) error {
+	err := os.Rename(source, target)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(target)
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		os.Remove(target)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(target)
+		return err
+	}
+
+	return os.Remove(source)
+}
@@ -0,0 +1,131 @@
+package dlq
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSalvageSegment(t *testing.T) {
+	tests := []struct {
+		name string
+		// cursor positions replay relative to the quarantined segment: -1
+		// before it, n at its item n, and len(items) past it
+		cursor       int
+		wantSalvaged int64
+		wantReplayed int64
+	}{
+		{name: "not replayed", cursor: -1, wantSalvaged: 4},
+		{name: "replay part way through", cursor: 2, wantSalvaged: 2, wantReplayed: 2},
+		{name: "fully replayed", cursor: 4, wantSalvaged: 0, wantReplayed: 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := newTestStorage(t, func(cfg *FileStorageConfig) {
+				cfg.Salvage = true
+			})
+
+			for priority := uint8(0); priority < 4; priority++ {
+				if err := fs.StorePriorityItem([]byte{'a' + priority}, priority); err != nil {
+					t.Fatal(err)
+				}
+			}
+			path, offsets := finalizeTestSegment(t, fs)
+			original := readSegmentRecords(t, path)
+
+			fs.mutex.Lock()
+			switch {
+			case tt.cursor < 0:
+				fs.cursor = replayCursor{}
+			case tt.cursor < len(offsets):
+				fs.cursor = replayCursor{Segment: filepath.Base(path), Offset: offsets[tt.cursor]}
+			default:
+				fs.cursor = replayCursor{Replayed: []string{filepath.Base(path)}}
+			}
+			salvageInto := fs.currentSegment.Name()
+			fs.mutex.Unlock()
+
+			if err := fs.quarantineSegment(path, errors.New("test corruption")); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := os.ReadFile(filepath.Join(fs.config.QuarantineDirectory, filepath.Base(path)+".json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var report quarantineReport
+			if err := json.Unmarshal(data, &report); err != nil {
+				t.Fatal(err)
+			}
+			if report.SalvagedItems != tt.wantSalvaged || report.ReplayedItems != tt.wantReplayed {
+				t.Errorf("salvaged %d and replayed %d, want %d and %d",
+					report.SalvagedItems, report.ReplayedItems, tt.wantSalvaged, tt.wantReplayed)
+			}
+
+			// Salvaged items keep their priority and storage time
+			fs.mutex.Lock()
+			if err := fs.finalizeSegment(); err != nil {
+				t.Fatal(err)
+			}
+			fs.mutex.Unlock()
+			salvaged := readSegmentRecords(t, salvageInto)
+			if int64(len(salvaged)) != tt.wantSalvaged {
+				t.Fatalf("found %d salvaged items, want %d", len(salvaged), tt.wantSalvaged)
+			}
+			skip := len(original) - len(salvaged)
+			for i, rec := range salvaged {
+				want := original[skip+i]
+				if rec.priority != want.priority || rec.storedAt != want.storedAt {
+					t.Errorf("item %d salvaged with priority %d at %d, want %d at %d",
+						i, rec.priority, rec.storedAt, want.priority, want.storedAt)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifySegmentsSkipsReplaying(t *testing.T) {
+	tests := []struct {
+		name            string
+		replaying       bool
+		wantQuarantined bool
+	}{
+		{name: "not replaying", wantQuarantined: true},
+		{name: "under the cursor", replaying: true, wantQuarantined: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := newTestStorage(t, nil)
+			if err := fs.StoreItem([]byte("item")); err != nil {
+				t.Fatal(err)
+			}
+			path, offsets := finalizeTestSegment(t, fs)
+			if tt.replaying {
+				fs.mutex.Lock()
+				fs.cursor = replayCursor{Segment: filepath.Base(path), Offset: offsets[0]}
+				fs.mutex.Unlock()
+			}
+
+			// Damage the header, failing verification
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data[0] ^= 0xff
+			if err := os.WriteFile(path, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			fs.verifySegments()
+
+			_, err = os.Stat(filepath.Join(fs.config.QuarantineDirectory, filepath.Base(path)))
+			if quarantined := err == nil; quarantined != tt.wantQuarantined {
+				t.Errorf("quarantined = %v, want %v", quarantined, tt.wantQuarantined)
+			}
+		})
+	}
+}
@@ -0,0 +1,321 @@
+package dlq
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"go.uber.org/zap"
+)
+
+// Segments replay read to their end without error, as the cursor lists them,
+// are deleted, or moved to the archive directory: replay releases each as it
+// finishes it, and what a crash or a failed release left behind is reclaimed
+// at start and before every replay. The segment the cursor stops in is then
+// compacted once at least half of it was delivered: its remaining items are
+// rewritten to a new file without holding the mutex, the cursor is moved to
+// the start, and the new file replaces the segment, unless the cursor moved
+// or replay started in the meantime. A crash between the last two steps
+// re-sends the delivered half, but never loses an item.
+
+const (
+	compactSuffix = ".compact"
+
+	reclaimDeleted   = "deleted"
+	reclaimArchived  = "archived"
+	reclaimCompacted = "compacted"
+)
+
+// removeStaleCompactions deletes rewritten segments a crash left behind. It
+// runs at start, before anything rewrites segments.
+func (fs *FileStorageExtension) removeStaleCompactions() {
+	stale, _ := filepath.Glob(filepath.Join(fs.config.Directory, "*"+compactSuffix))
+	for _, path := range stale {
+		os.Remove(path)
+	}
+}
+
+// reclaimReplayed releases the segments the cursor lists as replayed and
+// compacts the one it stops in
+func (fs *FileStorageExtension) reclaimReplayed() {
+	segments, err := fs.listSegments()
+	if err != nil {
+		fs.logger.Error("Failed to list segments for reclaiming", zap.Error(err))
+		return
+	}
+
+	fs.mutex.Lock()
+	compact := fs.releaseReplayedLocked(segments)
+	fs.mutex.Unlock()
+
+	if compact == "" {
+		return
+	}
+	if err := fs.compactReplayed(compact); err != nil {
+		fs.logger.Error("Failed to compact replayed segment",
+			zap.String("segment", compact),
+			zap.Error(err))
+	}
+}
+
+// releaseReplayedLocked releases the segments the cursor lists as replayed.
+// It returns the segment the cursor stops in, if replay delivered part of it
+// and it is not being written. Callers must hold the mutex.
+func (fs *FileStorageExtension) releaseReplayedLocked(segments []string) string {
+	var compact string
+	present := make(map[string]bool, len(segments))
+	for _, segmentPath := range segments {
+		segment := filepath.Base(segmentPath)
+		present[segment] = true
+		if fs.isCurrentSegment(segmentPath) {
+			continue
+		}
+
+		if fs.cursor.covers(segment) {
+			fs.releaseSegment(segmentPath)
+		} else if segment == fs.cursor.Segment && fs.cursor.Offset > int64(headerSize) {
+			compact = segmentPath
+		}
+	}
+
+	// Stop listing replayed segments that were removed otherwise, e.g.
+	// dropped to make room
+	for _, segment := range fs.cursor.Replayed {
+		if !present[segment] {
+			fs.cursor = fs.cursor.withoutReplayed(segment)
+			fs.cursorDirty = true
+		}
+	}
+	return compact
+}
+
+// isCurrentSegment reports whether a path is the segment being written.
+// Callers must hold the mutex.
+func (fs *FileStorageExtension) isCurrentSegment(path string) bool {
+	if fs.currentSegment == nil {
+		return false
+	}
+	currentPath, err := filepath.Abs(fs.currentSegment.Name())
+	if err != nil {
+		return false
+	}
+	absPath, err := filepath.Abs(path)
+	return err == nil && currentPath == absPath
+}
+
+// releaseSegment deletes or archives a fully replayed segment. Callers must
+// hold the mutex.
+func (fs *FileStorageExtension) releaseSegment(path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fs.logger.Error("Failed to stat replayed segment",
+				zap.String("segment", path),
+				zap.Error(err))
+		}
+		return
+	}
+
+	action := reclaimDeleted
+	if fs.config.ArchiveDirectory != "" {
+		action = reclaimArchived
+		target := filepath.Join(fs.config.ArchiveDirectory, filepath.Base(path))
+		if err = moveFile(path, target); err == nil {
+			moveFile(indexPath(path), indexPath(target))
+		}
+	} else {
+		err = os.Remove(path)
+		removeIndex(path)
+	}
+	if err != nil {
+		fs.logger.Error("Failed to release replayed segment",
+			zap.String("segment", path),
+			zap.String("action", action),
+			zap.Error(err))
+		return
+	}
+	fs.forgetSegment(path)
+	if fs.cursor.covers(filepath.Base(path)) {
+		fs.cursor = fs.cursor.withoutReplayed(filepath.Base(path))
+		fs.cursorDirty = true
+	}
+
+	fs.reclaimedBytes.WithLabelValues(action).Add(float64(info.Size()))
+	fs.logger.Info("Released replayed segment",
+		zap.String("segment", path),
+		zap.String("action", action),
+		zap.Int64("bytes", info.Size()))
+}
+
+// compactReplayed rewrites the undelivered items of the cursor's segment,
+// holding the mutex only to replace the segment
+func (fs *FileStorageExtension) compactReplayed(path string) error {
+	fs.mutex.Lock()
+	cursor := fs.cursor
+	usage := fs.usage[path]
+	fs.mutex.Unlock()
+	if filepath.Base(path) != cursor.Segment {
+		return nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to stat segment: %v", err)
+	}
+
+	delivered := cursor.Offset - int64(headerSize)
+	remaining := info.Size() - cursor.Offset
+	if remaining <= 0 {
+		fs.mutex.Lock()
+		if fs.cursor.Segment == cursor.Segment && fs.cursor.Offset == cursor.Offset && !fs.replayActive {
+			fs.releaseSegment(path)
+		}
+		fs.mutex.Unlock()
+		return nil
+	}
+	if delivered < remaining {
+		return nil
+	}
+
+	tmpPath, ix, err := fs.rewriteSegment(path, cursor.Offset, nil)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	compactedInfo, err := os.Stat(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to stat compacted segment: %v", err)
+	}
+
+	// Take both mutexes in the order flushCursor does
+	fs.cursorSaveMutex.Lock()
+	defer fs.cursorSaveMutex.Unlock()
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	// Replay may have moved the cursor, or the segment may have been
+	// removed, while it was copied
+	if fs.cursor.Segment != cursor.Segment || fs.cursor.Offset != cursor.Offset ||
+		fs.usage[path] != usage || fs.replayActive {
+		return nil
+	}
+
+	// Move the cursor before replacing the segment, so a crash in between
+	// re-sends items rather than skipping them
+	cursor = fs.cursor
+	cursor.Offset = int64(headerSize)
+	if err := saveCursor(fs.config.Directory, cursor); err != nil {
+		return err
+	}
+	fs.cursor = cursor
+	fs.cursorDirty = false
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to replace segment: %v", err)
+	}
+	fs.writeSegmentIndex(path, ix)
+	fs.trackSegment(path)
+
+	reclaimed := info.Size() - compactedInfo.Size()
+	fs.reclaimedBytes.WithLabelValues(reclaimCompacted).Add(float64(reclaimed))
+	fs.logger.Info("Compacted replayed segment",
+		zap.String("segment", path),
+		zap.Int64("items", ix.Items),
+		zap.Int64("bytes", reclaimed))
+	return nil
+}
+
+// rewriteSegment copies the items of a segment from an offset on, for which
+// keep returns true, to a new segment file next to it, dropping damaged
+// items. It returns the path of the new file, which the caller renames over
+// the segment or removes, and its index, carrying over the metadata of the
+// items from the segment's index.
+func (fs *FileStorageExtension) rewriteSegment(path string, from int64, keep func(record) bool) (string, *segmentIndex, error) {
+	source, err := os.Open(path)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to open segment: %v", err)
+	}
+	defer source.Close()
+
+	info, err := source.Stat()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to stat segment: %v", err)
+	}
+	var entries map[int64]indexRecord
+	if sourceIndex, err := loadIndex(path, info.Size()); err == nil {
+		entries = sourceIndex.lookup()
+	}
+
+	format, _, _, err := readHeader(source)
+	if err != nil {
+		return "", nil, err
+	}
+	reader, err := newSegmentReader(source, format, from)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Each rewrite gets its own file, as replay may compact a segment the
+	// compaction loop is still copying
+	target, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*"+compactSuffix)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create rewritten segment: %v", err)
+	}
+	defer target.Close()
+	tmpPath := target.Name()
+
+	fail := func(err error) (string, *segmentIndex, error) {
+		os.Remove(tmpPath)
+		return "", nil, err
+	}
+
+	if err := target.Chmod(0644); err != nil {
+		return fail(fmt.Errorf("failed to set segment permissions: %v", err))
+	}
+
+	if _, err := target.Write(placeholderHeader(currentFormat)); err != nil {
+		return fail(fmt.Errorf("failed to write header placeholder: %v", err))
+	}
+
+	hasher := sha256.New()
+	ix := newSegmentIndex(filepath.Base(path))
+	offset := from
+	for {
+		rec, size, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+		sourceOffset := offset
+		offset += size
+		if err == errRecordChecksum {
+			fs.corruptedItemsTotal.Inc()
+			continue
+		}
+		if err != nil {
+			return fail(fmt.Errorf("failed to read item: %v", err))
+		}
+		if keep != nil && !keep(rec) {
+			continue
+		}
+
+		written, err := writeRecord(target, rec)
+		if err != nil {
+			return fail(err)
+		}
+		hasher.Write(rec.data)
+
+		entry := entries[sourceOffset]
+		entry.Offset = ix.SizeBytes
+		entry.Size = written
+		entry.StoredAt = rec.storedAt
+		entry.Priority = rec.priority
+		ix.add(entry)
+	}
+	if err := writeSegmentHeader(target, currentFormat, ix.Items, hasher.Sum(nil)); err != nil {
+		return fail(err)
+	}
+
+	return tmpPath, ix, nil
+}
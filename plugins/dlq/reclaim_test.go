@@ -0,0 +1,174 @@
+package dlq
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReclaimReplayed(t *testing.T) {
+	tests := []struct {
+		name string
+		// cursor returns the cursor, given the names of two finalized
+		// segments, first sorting before second
+		cursor       func(first, second string) replayCursor
+		wantFirst    bool
+		wantReplayed []string
+	}{
+		{
+			name: "listed as replayed",
+			cursor: func(first, second string) replayCursor {
+				return replayCursor{Segment: second, Offset: int64(headerSize), Replayed: []string{first}}
+			},
+			wantFirst: false,
+		},
+		{
+			name: "before the cursor but not listed",
+			cursor: func(first, second string) replayCursor {
+				return replayCursor{Segment: second, Offset: int64(headerSize)}
+			},
+			wantFirst: true,
+		},
+		{
+			name: "listed segment removed otherwise",
+			cursor: func(first, second string) replayCursor {
+				return replayCursor{Segment: second, Replayed: []string{"segment_gone.dlq"}}
+			},
+			wantFirst: true,
+		},
+		{
+			name: "listed after the cursor",
+			cursor: func(first, second string) replayCursor {
+				return replayCursor{Segment: first, Offset: int64(headerSize), Replayed: []string{second}}
+			},
+			wantFirst: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := newTestStorage(t, nil)
+
+			var paths []string
+			for s := 0; s < 2; s++ {
+				for i := 0; i < 3; i++ {
+					if err := fs.StoreItem([]byte(fmt.Sprintf("item-%d-%d", s, i))); err != nil {
+						t.Fatal(err)
+					}
+				}
+				path, _ := finalizeTestSegment(t, fs)
+				paths = append(paths, path)
+			}
+			first, second := filepath.Base(paths[0]), filepath.Base(paths[1])
+			if first >= second {
+				// Segments created in the same second take a suffix
+				t.Fatalf("segments %s and %s out of order", first, second)
+			}
+
+			fs.mutex.Lock()
+			fs.cursor = tt.cursor(first, second)
+			fs.mutex.Unlock()
+
+			fs.reclaimReplayed()
+
+			_, err := os.Stat(paths[0])
+			if exists := err == nil; exists != tt.wantFirst {
+				t.Errorf("first segment kept = %v, want %v", exists, tt.wantFirst)
+			}
+			fs.mutex.Lock()
+			replayed := fs.cursor.Replayed
+			fs.mutex.Unlock()
+			if len(replayed) != len(tt.wantReplayed) {
+				t.Errorf("cursor lists %v as replayed, want %v", replayed, tt.wantReplayed)
+			}
+		})
+	}
+}
+
+func TestCompactReplayed(t *testing.T) {
+	tests := []struct {
+		name         string
+		cursorItem   int // the item of six the cursor is at
+		replayActive bool
+		wantItems    int
+	}{
+		{name: "mostly delivered", cursorItem: 4, wantItems: 2},
+		{name: "less than half delivered", cursorItem: 2, wantItems: 6},
+		{name: "replay started meanwhile", cursorItem: 4, replayActive: true, wantItems: 6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := newTestStorage(t, nil)
+			for i := 0; i < 6; i++ {
+				if err := fs.StoreItem([]byte(fmt.Sprintf("item-%d", i))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			path, offsets := finalizeTestSegment(t, fs)
+
+			fs.mutex.Lock()
+			fs.cursor = replayCursor{Segment: filepath.Base(path), Offset: offsets[tt.cursorItem]}
+			fs.replayActive = tt.replayActive
+			fs.mutex.Unlock()
+
+			if err := fs.compactReplayed(path); err != nil {
+				t.Fatal(err)
+			}
+
+			fs.mutex.Lock()
+			fs.replayActive = false
+			cursor := fs.cursor
+			fs.mutex.Unlock()
+			if got := len(readSegmentRecords(t, path)); got != tt.wantItems {
+				t.Errorf("segment holds %d items, want %d", got, tt.wantItems)
+			}
+			wantOffset := offsets[tt.cursorItem]
+			if tt.wantItems < 6 {
+				wantOffset = int64(headerSize)
+			}
+			if cursor.Offset != wantOffset {
+				t.Errorf("cursor offset = %d, want %d", cursor.Offset, wantOffset)
+			}
+		})
+	}
+}
+
+func TestStartReplayQueue(t *testing.T) {
+	fs := newTestStorage(t, nil)
+
+	var paths []string
+	for s := 0; s < 2; s++ {
+		if err := fs.StoreItem([]byte(fmt.Sprintf("item-%d", s))); err != nil {
+			t.Fatal(err)
+		}
+		path, _ := finalizeTestSegment(t, fs)
+		paths = append(paths, path)
+	}
+
+	fs.mutex.Lock()
+	fs.cursor = replayCursor{Replayed: []string{filepath.Base(paths[0])}}
+	fs.mutex.Unlock()
+
+	// Replay starts with a live window, leaving the queue as it was built
+	if err := fs.StartReplay(context.Background(), func([]byte) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	fs.mutex.Lock()
+	queue := append([]string(nil), fs.replayQueue...)
+	fs.mutex.Unlock()
+
+	if _, err := os.Stat(paths[0]); err == nil {
+		t.Errorf("replayed segment was not released")
+	}
+	for _, path := range queue {
+		if path == paths[0] {
+			t.Errorf("released segment queued for replay: %v", queue)
+		}
+	}
+	if len(queue) == 0 || queue[0] != paths[1] {
+		t.Errorf("queue = %v, want it to start with %s", queue, paths[1])
+	}
+}
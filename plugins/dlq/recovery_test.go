@@ -0,0 +1,123 @@
+package dlq
+
+import (
+	"os"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestRecoverSegment(t *testing.T) {
+	// Damage is applied to an unfinalized segment holding five items;
+	// offsets[i] is where item i starts
+	tests := []struct {
+		name          string
+		finalize      bool
+		damage        func(data []byte, offsets []int64) []byte
+		wantRecovered bool
+		wantRecords   int64
+		wantDamaged   int64
+		wantTruncated func(size int64, offsets []int64) int64
+	}{
+		{
+			name:          "finalized segment is left alone",
+			finalize:      true,
+			damage:        func(data []byte, _ []int64) []byte { return data },
+			wantRecovered: false,
+		},
+		{
+			name:          "intact",
+			damage:        func(data []byte, _ []int64) []byte { return data },
+			wantRecovered: true,
+			wantRecords:   5,
+		},
+		{
+			name: "torn tail is truncated",
+			damage: func(data []byte, offsets []int64) []byte {
+				return data[:offsets[4]+30]
+			},
+			wantRecovered: true,
+			wantRecords:   4,
+			wantTruncated: func(size int64, offsets []int64) int64 { return size - offsets[4] },
+		},
+		{
+			name: "mid-segment damage is skipped and kept",
+			damage: func(data []byte, offsets []int64) []byte {
+				data[offsets[2]+30] ^= 0xff
+				return data
+			},
+			wantRecovered: true,
+			wantRecords:   4,
+			wantDamaged:   1,
+		},
+		{
+			name: "mid-segment damage before a torn tail",
+			damage: func(data []byte, offsets []int64) []byte {
+				data[offsets[1]+4] ^= 0xff
+				return data[:offsets[4]+5]
+			},
+			wantRecovered: true,
+			wantRecords:   3,
+			wantDamaged:   1,
+			wantTruncated: func(size int64, offsets []int64) int64 { return size - offsets[4] },
+		},
+		{
+			name: "damaged last item is part of the torn tail",
+			damage: func(data []byte, offsets []int64) []byte {
+				for i := offsets[4] + 30; i < int64(len(data)); i++ {
+					data[i] = 0
+				}
+				return data
+			},
+			wantRecovered: true,
+			wantRecords:   4,
+			wantTruncated: func(size int64, offsets []int64) int64 { return size - offsets[4] },
+		},
+	}
+
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoder.Close()
+
+	payloads := testPayloads(5)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, offsets := writeTestSegment(t, payloads, tt.finalize)
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data = tt.damage(data, offsets)
+			if err := os.WriteFile(path, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			recovered, records, damaged, truncated, err := recoverSegment(path, decoder)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if recovered != tt.wantRecovered {
+				t.Fatalf("recovered = %v, want %v", recovered, tt.wantRecovered)
+			}
+			if !recovered {
+				return
+			}
+			var wantTruncated int64
+			if tt.wantTruncated != nil {
+				wantTruncated = tt.wantTruncated(int64(len(data)), offsets)
+			}
+			if records != tt.wantRecords || damaged != tt.wantDamaged || truncated != wantTruncated {
+				t.Errorf("got %d records, %d damaged, %d truncated; want %d, %d, %d",
+					records, damaged, truncated, tt.wantRecords, tt.wantDamaged, wantTruncated)
+			}
+
+			// The recovered segment must pass verification
+			fs := &FileStorageExtension{}
+			if gotDamaged, err := fs.verifySegment(path); err != nil || gotDamaged != tt.wantDamaged {
+				t.Errorf("verifySegment() = %d, %v; want %d damaged", gotDamaged, err, tt.wantDamaged)
+			}
+		})
+	}
+}
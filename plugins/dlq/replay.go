@@ -0,0 +1,170 @@
+package dlq
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"time"
+)
+
+// Replay reads segments at a byte rate, saving up at most a burst while it
+// leaves the exporter to live traffic, and alternates between replaying and
+// live windows within each replay cycle. With adaptive replay the rate ramps
+// up while upstream keeps accepting items, is halved when upstream throttles
+// and eased off when callbacks get slower than their usual latency, within
+// the configured bounds.
+
+// ReplayConfig sets how fast the DLQ replays
+type ReplayConfig struct {
+	// RateMiBps is the replay rate, or the rate adaptive replay starts at
+	RateMiBps float64 `mapstructure:"rate_mib_per_sec"`
+
+	// BurstMiB bounds the bytes replay can save up while live traffic has
+	// the exporter
+	BurstMiB float64 `mapstructure:"burst_mib"`
+
+	// InterleaveRatio is the share of each replay cycle spent replaying, 1
+	// replaying without pause
+	InterleaveRatio float64 `mapstructure:"interleave_ratio"`
+
+	// Adaptive adjusts the rate to what upstream accepts
+	Adaptive AdaptiveReplayConfig `mapstructure:"adaptive"`
+}
+
+// AdaptiveReplayConfig bounds how adaptive replay adjusts its rate
+type AdaptiveReplayConfig struct {
+	Enabled      bool    `mapstructure:"enabled"`
+	MinRateMiBps float64 `mapstructure:"min_rate_mib_per_sec"`
+	MaxRateMiBps float64 `mapstructure:"max_rate_mib_per_sec"`
+
+	// LatencyFactor is how many times slower than usual callbacks get
+	// before replay eases off
+	LatencyFactor float64 `mapstructure:"latency_factor"`
+}
+
+const (
+	defaultReplayRateMiBps       = 4 // 4 MiB/s
+	defaultReplayBurstMiB        = 2
+	defaultReplayInterleaveRatio = 0.5 // 1:1 replay and live
+	defaultReplayMinRateMiBps    = 1
+	defaultReplayMaxRateMiBps    = 64
+	defaultReplayLatencyFactor   = 2
+
+	replayTokenInterval = 10 * time.Millisecond
+	replayCycle         = time.Second
+	minReplayBackoff    = 100 * time.Millisecond
+
+	// Adaptive replay steps
+	replayAdjustInterval = time.Second
+	replayRampUp         = 1.25
+	replayEaseOff        = 0.8
+	replayBackOff        = 0.5
+	latencySmoothing     = 0.2  // weight of a new sample in the average
+	latencyBaselineDrift = 0.01 // how fast the usual latency follows a slower one
+)
+
+// ErrThrottled can be wrapped by a replay callback to report that upstream
+// asked it to slow down. Errors with a StatusCode() method returning 429 or
+// 503 count as well.
+var ErrThrottled = errors.New("replay throttled by upstream")
+
+// replayWindows returns how long each cycle replays and leaves the exporter
+// to live traffic
+func (fs *FileStorageExtension) replayWindows() (time.Duration, time.Duration) {
+	replay := time.Duration(float64(replayCycle) * fs.config.Replay.InterleaveRatio)
+	return replay, replayCycle - replay
+}
+
+// replayRate is the rate replay reads at. It is only used by the replay
+// loop.
+type replayRate struct {
+	config      AdaptiveReplayConfig
+	bytesPerSec float64
+	minBytes    float64
+	maxBytes    float64
+
+	latency    float64 // average callback latency, in seconds
+	baseline   float64 // usual callback latency, in seconds
+	accepted   int64   // callbacks accepted since the last adjustment
+	throttled  bool
+	lastAdjust time.Time
+}
+
+// newReplayRate returns the rate replay starts at
+func newReplayRate(config ReplayConfig) *replayRate {
+	return &replayRate{
+		config:      config.Adaptive,
+		bytesPerSec: config.RateMiBps * 1024 * 1024,
+		minBytes:    config.Adaptive.MinRateMiBps * 1024 * 1024,
+		maxBytes:    config.Adaptive.MaxRateMiBps * 1024 * 1024,
+		lastAdjust:  time.Now(),
+	}
+}
+
+// observe records the outcome of a callback
+func (r *replayRate) observe(latency time.Duration, err error) {
+	if !r.config.Enabled {
+		return
+	}
+	if err != nil {
+		if isThrottled(err) {
+			r.throttled = true
+		}
+		return
+	}
+
+	sample := latency.Seconds()
+	if r.latency == 0 {
+		r.latency = sample
+	} else {
+		r.latency += (sample - r.latency) * latencySmoothing
+	}
+	if r.baseline == 0 || r.latency < r.baseline {
+		r.baseline = r.latency
+	} else {
+		r.baseline += (r.latency - r.baseline) * latencyBaselineDrift
+	}
+	r.accepted++
+}
+
+// adjust applies what callbacks reported since the last adjustment and
+// returns the rate in bytes per second
+func (r *replayRate) adjust(now time.Time) float64 {
+	if !r.config.Enabled {
+		return r.bytesPerSec
+	}
+
+	switch {
+	case r.throttled:
+		// Back off at once, rather than at the next adjustment
+		r.bytesPerSec = math.Max(r.bytesPerSec*replayBackOff, r.minBytes)
+	case now.Sub(r.lastAdjust) < replayAdjustInterval:
+		return r.bytesPerSec
+	case r.accepted == 0:
+		// Nothing was delivered to go by
+	case r.latency > r.baseline*r.config.LatencyFactor:
+		r.bytesPerSec = math.Max(r.bytesPerSec*replayEaseOff, r.minBytes)
+	default:
+		r.bytesPerSec = math.Min(r.bytesPerSec*replayRampUp, r.maxBytes)
+	}
+
+	r.throttled = false
+	r.accepted = 0
+	r.lastAdjust = now
+	return r.bytesPerSec
+}
+
+// isThrottled reports whether a callback error means upstream asked replay
+// to slow down
+func isThrottled(err error) bool {
+	if errors.Is(err, ErrThrottled) {
+		return true
+	}
+
+	var coded interface{ StatusCode() int }
+	if errors.As(err, &coded) {
+		code := coded.StatusCode()
+		return code == http.StatusTooManyRequests || code == http.StatusServiceUnavailable
+	}
+	return false
+}
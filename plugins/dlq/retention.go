@@ -0,0 +1,102 @@
+package dlq
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Items older than max_age fall outside the backend's ingest window, so they
+// are not worth the disk or the replay bandwidth. A sweeper deletes segments
+// whose newest item has expired, and replay skips expired items of segments
+// that still hold newer ones. Age is measured from when an item entered the
+// DLQ; segments written before items carried a timestamp are aged by their
+// last write.
+
+const (
+	retentionInterval = time.Minute
+
+	expireDeleted = "deleted"
+	expireSkipped = "skipped"
+)
+
+// retentionLoop periodically expires segments past max_age
+func (fs *FileStorageExtension) retentionLoop(ctx context.Context) {
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+
+	fs.expireSegments()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fs.expireSegments()
+		}
+	}
+}
+
+// expireSegments deletes every segment whose items have all expired, other
+// than the one being written and the one replay is reading
+func (fs *FileStorageExtension) expireSegments() {
+	cutoff := fs.expiryCutoff()
+	if cutoff == 0 {
+		return
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	for _, path := range fs.trackedSegments() {
+		usage := fs.usage[path]
+		if !isExpired(usage.newest, cutoff) || fs.isCurrentSegment(path) {
+			continue
+		}
+		if fs.replayActive && len(fs.replayQueue) > 0 && fs.replayQueue[0] == path {
+			continue
+		}
+
+		if err := fs.removeSegment(path); err != nil {
+			fs.logger.Error("Failed to delete expired segment",
+				zap.String("segment", path),
+				zap.Error(err))
+			continue
+		}
+		fs.dequeueReplay(path)
+
+		fs.expiredRecords.WithLabelValues(expireDeleted).Add(float64(usage.items))
+		fs.logger.Info("Deleted expired segment",
+			zap.String("segment", path),
+			zap.Int64("items", usage.items),
+			zap.Int64("bytes", usage.size),
+			zap.Time("newest_item", time.Unix(0, usage.newest)))
+	}
+}
+
+// dequeueReplay drops a removed segment from the replay queue. Callers must
+// hold the mutex.
+func (fs *FileStorageExtension) dequeueReplay(path string) {
+	queue := fs.replayQueue[:0]
+	for _, queued := range fs.replayQueue {
+		if queued != path {
+			queue = append(queue, queued)
+		}
+	}
+	fs.replayQueue = queue
+}
+
+// expiryCutoff returns the storage time, in Unix nanoseconds, before which
+// items have expired, or 0 if items do not expire
+func (fs *FileStorageExtension) expiryCutoff() int64 {
+	if fs.config.MaxAge <= 0 {
+		return 0
+	}
+	return time.Now().Add(-fs.config.MaxAge).UnixNano()
+}
+
+// isExpired reports whether an item stored at a time has expired. Items
+// without a timestamp never do.
+func isExpired(storedAt, cutoff int64) bool {
+	return cutoff > 0 && storedAt > 0 && storedAt < cutoff
+}
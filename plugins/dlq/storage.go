@@ -0,0 +1,589 @@
+package dlq
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"go.opentelemetry.io/collector/component"
+	"go.opentelemetry.io/collector/extension/experimental/storage"
+	"go.uber.org/zap"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Storage clients give other components, such as the exporterhelper
+// persistent queue, a key-value store kept in the DLQ segment format. Each
+// client appends its writes to its own directory of segments, one record per
+// Set, Delete or Batch, so a batch is applied entirely or not at all after a
+// crash. Like DLQ items, records reach the disk when their segment is
+// finalized, so a crash can lose the latest batches. Live keys are held in
+// memory and rebuilt from the segments when the client is opened. Once the
+// segments hold more than compactionRatio times the live data, they are
+// rewritten into a single fresh segment.
+//
+// Client segments count toward max_total_bytes. They are never dropped to
+// make room, so they only reduce the room left for DLQ items.
+
+const (
+	// clientsDirectory holds one directory per storage client
+	clientsDirectory = "storage"
+
+	opSet    byte = 1
+	opDelete byte = 2
+
+	compactionRatio = 2
+
+	// snapshotRecordSize bounds the records written by compaction
+	snapshotRecordSize = 4 * 1024 * 1024
+)
+
+// fileStorageClient is the storage.Client of one component
+type fileStorageClient struct {
+	name           string
+	dir            string
+	logger         *zap.Logger
+	maxSegmentSize int64
+	compressor     *zstd.Encoder
+	decompressor   *zstd.Decoder
+	onClose        func()
+
+	// diskBytes is shared by all clients of the extension and follows the
+	// size of their segments on disk
+	diskBytes *atomic.Int64
+
+	mutex     sync.Mutex
+	entries   map[string][]byte
+	liveBytes int64
+	closed    bool
+
+	// Segments, oldest first; the last one is the active segment
+	segments    []string
+	logBytes    int64
+	nextSegment uint64
+
+	segment          *os.File
+	segmentSize      int64
+	segmentItemCount int64
+	hasher           hash.Hash
+}
+
+var _ storage.Client = (*fileStorageClient)(nil)
+
+// clientName builds the directory name of a component's storage
+func clientName(kind component.Kind, id component.ID, storageName string) string {
+	parts := []string{strings.ToLower(kind.String()), string(id.Type())}
+	if id.Name() != "" {
+		parts = append(parts, id.Name())
+	}
+	if storageName != "" {
+		parts = append(parts, storageName)
+	}
+
+	// Keep the name a single safe path element
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '.':
+			return r
+		}
+		return '_'
+	}, strings.Join(parts, "_"))
+}
+
+// newFileStorageClient opens the storage in dir, rebuilding its keys from
+// any existing segments. Existing segments must already be counted in
+// diskBytes.
+func newFileStorageClient(name, dir string, maxSegmentSize int64, compressor *zstd.Encoder, diskBytes *atomic.Int64, logger *zap.Logger) (*fileStorageClient, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %v", err)
+	}
+
+	decompressor, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstd decoder: %v", err)
+	}
+
+	c := &fileStorageClient{
+		name:           name,
+		dir:            dir,
+		logger:         logger.With(zap.String("client", name)),
+		maxSegmentSize: maxSegmentSize,
+		compressor:     compressor,
+		decompressor:   decompressor,
+		diskBytes:      diskBytes,
+		entries:        make(map[string][]byte),
+	}
+
+	if err := c.load(); err != nil {
+		decompressor.Close()
+		return nil, err
+	}
+
+	// Start from a compacted segment, which also drops any torn tail
+	if len(c.segments) > 0 {
+		err = c.compact()
+	} else {
+		err = c.openSegment()
+	}
+	if err != nil {
+		decompressor.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Get returns the value of a key, or nil if it is not set
+func (c *fileStorageClient) Get(ctx context.Context, key string) ([]byte, error) {
+	op := storage.GetOperation(key)
+	if err := c.Batch(ctx, op); err != nil {
+		return nil, err
+	}
+	return op.Value, nil
+}
+
+// Set stores the value of a key
+func (c *fileStorageClient) Set(ctx context.Context, key string, value []byte) error {
+	return c.Batch(ctx, storage.SetOperation(key, value))
+}
+
+// Delete removes a key
+func (c *fileStorageClient) Delete(ctx context.Context, key string) error {
+	return c.Batch(ctx, storage.DeleteOperation(key))
+}
+
+// Batch applies operations in order. Writes are appended as one record
+// before any of them is applied, and Get results are put in place.
+func (c *fileStorageClient) Batch(_ context.Context, ops ...storage.Operation) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return errors.New("storage client is closed")
+	}
+
+	if record := encodeOperations(ops); record != nil {
+		if err := c.appendRecord(record); err != nil {
+			return err
+		}
+	}
+
+	c.apply(ops)
+	return nil
+}
+
+// apply applies operations to the live keys in order
+func (c *fileStorageClient) apply(ops []storage.Operation) {
+	for _, op := range ops {
+		switch op.Type {
+		case storage.Get:
+			if value, ok := c.entries[op.Key]; ok {
+				op.Value = append([]byte(nil), value...)
+			} else {
+				op.Value = nil
+			}
+		case storage.Set:
+			c.set(op.Key, append([]byte(nil), op.Value...))
+		case storage.Delete:
+			c.delete(op.Key)
+		}
+	}
+}
+
+// Close finalizes the active segment and releases the client
+func (c *fileStorageClient) Close(_ context.Context) error {
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return nil
+	}
+	c.closed = true
+	err := c.closeSegment()
+	c.decompressor.Close()
+	c.mutex.Unlock()
+
+	if c.onClose != nil {
+		c.onClose()
+	}
+	return err
+}
+
+func (c *fileStorageClient) set(key string, value []byte) {
+	if old, ok := c.entries[key]; ok {
+		c.liveBytes -= int64(len(key) + len(old))
+	}
+	c.entries[key] = value
+	c.liveBytes += int64(len(key) + len(value))
+}
+
+func (c *fileStorageClient) delete(key string) {
+	if old, ok := c.entries[key]; ok {
+		c.liveBytes -= int64(len(key) + len(old))
+		delete(c.entries, key)
+	}
+}
+
+// encodeOperations encodes the writes among ops as a record of
+// [op][key length][key] entries, with [value length][value] following sets.
+// It returns nil if there are no writes.
+func encodeOperations(ops []storage.Operation) []byte {
+	var record []byte
+	for _, op := range ops {
+		switch op.Type {
+		case storage.Set:
+			record = appendOperation(record, opSet, op.Key, op.Value)
+		case storage.Delete:
+			record = appendOperation(record, opDelete, op.Key, nil)
+		}
+	}
+	return record
+}
+
+func appendOperation(record []byte, op byte, key string, value []byte) []byte {
+	record = append(record, op)
+	record = binary.BigEndian.AppendUint32(record, uint32(len(key)))
+	record = append(record, key...)
+	if op == opSet {
+		record = binary.BigEndian.AppendUint32(record, uint32(len(value)))
+		record = append(record, value...)
+	}
+	return record
+}
+
+// decodeOperations decodes a record read back from a segment
+func decodeOperations(record []byte) ([]storage.Operation, error) {
+	readField := func() ([]byte, error) {
+		if len(record) < 4 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		size := binary.BigEndian.Uint32(record)
+		if uint64(len(record)-4) < uint64(size) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		field := record[4 : 4+size]
+		record = record[4+size:]
+		return field, nil
+	}
+
+	var ops []storage.Operation
+	for len(record) > 0 {
+		op := record[0]
+		record = record[1:]
+
+		key, err := readField()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key: %v", err)
+		}
+
+		switch op {
+		case opSet:
+			value, err := readField()
+			if err != nil {
+				return nil, fmt.Errorf("failed to read value: %v", err)
+			}
+			ops = append(ops, storage.SetOperation(string(key), value))
+		case opDelete:
+			ops = append(ops, storage.DeleteOperation(string(key)))
+		default:
+			return nil, fmt.Errorf("unknown operation %d", op)
+		}
+	}
+
+	return ops, nil
+}
+
+// load rebuilds the keys from the segments in the client directory. Damaged
+// records are skipped, while a record cut short with nothing intact after it
+// ends its segment, being the torn tail of a write interrupted by a crash.
+func (c *fileStorageClient) load() error {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read directory: %v", err)
+	}
+
+	for _, entry := range entries {
+		var seq uint64
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".dlq" {
+			continue
+		}
+		if _, err := fmt.Sscanf(entry.Name(), "segment_%d.dlq", &seq); err != nil {
+			continue
+		}
+		c.segments = append(c.segments, filepath.Join(c.dir, entry.Name()))
+		if seq >= c.nextSegment {
+			c.nextSegment = seq + 1
+		}
+	}
+	// Names are zero padded, so they sort by sequence
+	sort.Strings(c.segments)
+
+	for _, path := range c.segments {
+		size, err := c.loadSegment(path)
+		if err != nil {
+			return err
+		}
+		c.logBytes += size
+	}
+
+	return nil
+}
+
+// loadSegment applies the records of one segment and returns its size
+func (c *fileStorageClient) loadSegment(path string) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open segment: %v", err)
+	}
+	defer file.Close()
+
+	format, _, _, err := readHeader(file)
+	if err != nil {
+		c.logger.Warn("Skipping storage segment without a valid header",
+			zap.String("segment", path),
+			zap.Error(err))
+		return 0, nil
+	}
+
+	reader, err := newSegmentReader(file, format, int64(headerSize))
+	if err != nil {
+		return 0, err
+	}
+	size := int64(headerSize)
+	for {
+		rec, recordSize, err := reader.next()
+		if err == io.EOF {
+			return size, nil
+		}
+		if err == errRecordChecksum {
+			c.logger.Warn("Skipping damaged record of storage segment",
+				zap.String("segment", path),
+				zap.Int64("offset", size))
+			size += recordSize
+			continue
+		}
+		if err != nil {
+			c.logger.Warn("Discarding unreadable tail of storage segment",
+				zap.String("segment", path),
+				zap.Int64("offset", size),
+				zap.Error(err))
+			return size, nil
+		}
+
+		var ops []storage.Operation
+		encoded, err := c.decompressor.DecodeAll(rec.data, nil)
+		if err == nil {
+			ops, err = decodeOperations(encoded)
+		}
+		if err != nil {
+			c.logger.Warn("Discarding corrupted record of storage segment",
+				zap.String("segment", path),
+				zap.Int64("offset", size),
+				zap.Error(err))
+			return size, nil
+		}
+		c.apply(ops)
+		size += recordSize
+	}
+}
+
+// appendRecord compresses and writes a record to the active segment. A full
+// segment is rotated first, so a record is never written without being
+// applied.
+func (c *fileStorageClient) appendRecord(encoded []byte) error {
+	if c.segment == nil || c.segmentSize >= c.maxSegmentSize {
+		if err := c.rotate(); err != nil {
+			return fmt.Errorf("failed to rotate segment: %v", err)
+		}
+	}
+
+	compressed := c.compressor.EncodeAll(encoded, nil)
+	written, err := writeRecord(c.segment, record{data: compressed})
+	c.segmentSize += written
+	c.logBytes += written
+	c.diskBytes.Add(written)
+	if err != nil {
+		return err
+	}
+	c.hasher.Write(compressed)
+	c.segmentItemCount++
+	return nil
+}
+
+// rotate starts a new segment, compacting all segments into it if they hold
+// mostly overwritten or deleted keys
+func (c *fileStorageClient) rotate() error {
+	if c.logBytes > compactionRatio*(c.liveBytes+headerSize) {
+		return c.compact()
+	}
+	if err := c.closeSegment(); err != nil {
+		return err
+	}
+	return c.openSegment()
+}
+
+// compact writes all live keys to a new segment and removes the older
+// segments. Until they are removed, loading replays the older segments first
+// and the new one last, so a crash part way through loses nothing.
+func (c *fileStorageClient) compact() error {
+	if err := c.closeSegment(); err != nil {
+		return err
+	}
+	old, oldBytes := c.segments, c.logBytes
+	c.segments = nil
+	if err := c.openSegment(); err != nil {
+		c.segments = old
+		return err
+	}
+
+	keys, err := c.writeSnapshot()
+	if err != nil {
+		// The older segments still hold every key, so drop the partial
+		// snapshot and keep appending after them
+		c.discardSegment()
+		c.segments, c.logBytes = old, oldBytes
+		return err
+	}
+
+	for _, path := range old {
+		info, err := os.Stat(path)
+		if err == nil {
+			err = os.Remove(path)
+		}
+		if err != nil {
+			if !os.IsNotExist(err) {
+				c.logger.Warn("Failed to remove compacted storage segment",
+					zap.String("segment", path),
+					zap.Error(err))
+			}
+			continue
+		}
+		c.diskBytes.Add(-info.Size())
+	}
+	c.logBytes = c.segmentSize
+
+	c.logger.Debug("Compacted storage segments",
+		zap.Int("segments", len(old)),
+		zap.Int("keys", keys),
+		zap.Int64("bytes", c.segmentSize))
+	return nil
+}
+
+// writeSnapshot writes every live key to the active segment and makes it
+// durable, returning the number of keys written
+func (c *fileStorageClient) writeSnapshot() (int, error) {
+	keys := make([]string, 0, len(c.entries))
+	for key := range c.entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var record []byte
+	for _, key := range keys {
+		record = appendOperation(record, opSet, key, c.entries[key])
+		if len(record) >= snapshotRecordSize {
+			if err := c.writeSnapshotRecord(record); err != nil {
+				return 0, err
+			}
+			record = record[:0]
+		}
+	}
+	if len(record) > 0 {
+		if err := c.writeSnapshotRecord(record); err != nil {
+			return 0, err
+		}
+	}
+
+	// The snapshot and its directory entry must be on disk before the
+	// segments it replaces are removed
+	if err := c.segment.Sync(); err != nil {
+		return 0, fmt.Errorf("failed to sync segment: %v", err)
+	}
+	if err := syncDir(c.dir); err != nil {
+		return 0, err
+	}
+	return len(keys), nil
+}
+
+// writeSnapshotRecord writes a compaction record without rotating
+func (c *fileStorageClient) writeSnapshotRecord(encoded []byte) error {
+	compressed := c.compressor.EncodeAll(encoded, nil)
+	written, err := writeRecord(c.segment, record{data: compressed})
+	c.segmentSize += written
+	c.diskBytes.Add(written)
+	if err != nil {
+		return err
+	}
+	c.hasher.Write(compressed)
+	c.segmentItemCount++
+	return nil
+}
+
+// openSegment creates the next segment and makes it active
+func (c *fileStorageClient) openSegment() error {
+	path := filepath.Join(c.dir, fmt.Sprintf("segment_%016d.dlq", c.nextSegment))
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create segment file: %v", err)
+	}
+
+	// Write placeholder header (will be updated when segment is closed)
+	if _, err := file.Write(placeholderHeader(currentFormat)); err != nil {
+		file.Close()
+		os.Remove(path)
+		return fmt.Errorf("failed to write header placeholder: %v", err)
+	}
+
+	c.nextSegment++
+	c.segments = append(c.segments, path)
+	c.segment = file
+	c.segmentSize = int64(headerSize)
+	c.segmentItemCount = 0
+	c.hasher = sha256.New()
+	c.logBytes += int64(headerSize)
+	c.diskBytes.Add(int64(headerSize))
+	return nil
+}
+
+// discardSegment closes and removes the active segment
+func (c *fileStorageClient) discardSegment() {
+	path := c.segments[len(c.segments)-1]
+	c.segments = c.segments[:len(c.segments)-1]
+	c.segment.Close()
+	c.segment = nil
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		c.logger.Warn("Failed to remove partial storage segment",
+			zap.String("segment", path),
+			zap.Error(err))
+		return
+	}
+	c.diskBytes.Add(-c.segmentSize)
+}
+
+// closeSegment finalizes and closes the active segment, if any
+func (c *fileStorageClient) closeSegment() error {
+	if c.segment == nil {
+		return nil
+	}
+	file := c.segment
+	c.segment = nil
+
+	if err := writeSegmentHeader(file, currentFormat, c.segmentItemCount, c.hasher.Sum(nil)); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to finalize segment: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close segment: %v", err)
+	}
+	return nil
+}
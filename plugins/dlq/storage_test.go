@@ -0,0 +1,80 @@
+package dlq
+
+import (
+	"context"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"go.uber.org/zap"
+)
+
+func TestStorageClientDiskBytes(t *testing.T) {
+	tests := []struct {
+		name    string
+		writes  int
+		deletes int
+	}{
+		{name: "empty", writes: 0},
+		{name: "sets", writes: 200},
+		{name: "sets and deletes compacted", writes: 2000, deletes: 1900},
+	}
+
+	compressor, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer compressor.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			dir := filepath.Join(root, "client")
+			var diskBytes atomic.Int64
+			ctx := context.Background()
+
+			// A small segment size forces rotations and compactions
+			c, err := newFileStorageClient("client", dir, 4096, compressor, &diskBytes, zap.NewNop())
+			if err != nil {
+				t.Fatal(err)
+			}
+			value := make([]byte, 100)
+			for i := 0; i < tt.writes; i++ {
+				if err := c.Set(ctx, "key-"+strconv.Itoa(i%500), value); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := 0; i < tt.deletes; i++ {
+				if err := c.Delete(ctx, "key-"+strconv.Itoa(i%500)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := c.Close(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			if got, want := diskBytes.Load(), clientSegmentBytes(root); got != want {
+				t.Errorf("diskBytes = %d, segments on disk = %d", got, want)
+			}
+
+			// Reopening compacts the segments and keeps the keys
+			c, err = newFileStorageClient("client", dir, 4096, compressor, &diskBytes, zap.NewNop())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close(ctx)
+			if got, want := diskBytes.Load(), clientSegmentBytes(root); got != want {
+				t.Errorf("after reopen diskBytes = %d, segments on disk = %d", got, want)
+			}
+			live := 0
+			if tt.writes > 0 {
+				live = min(tt.writes, 500) - min(tt.deletes, 500)
+			}
+			if len(c.entries) != live {
+				t.Errorf("reopened with %d keys, want %d", len(c.entries), live)
+			}
+		})
+	}
+}
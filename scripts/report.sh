@@ -8,6 +8,7 @@ set -e
 PROM_URL="${PROM_URL:-http://localhost:9090}"
 COLLECTOR_URL="${COLLECTOR_URL:-http://localhost:4318}"
 UPSTREAM_URL="${UPSTREAM_URL:-http://localhost:4319}"
+CL_DEBUG_URL="${CL_DEBUG_URL:-http://localhost:55679/debug/cardinalitylimiter}"
 FORMAT="${FORMAT:-color}"  # color, plain, json
 
 # Colors for output (only if format=color)
@@ -204,6 +205,17 @@ fi
 
 print_metric "Keys Tracked" "$KEYS_USED" "$KEYS_STATUS" "(max: 65536)"
 print_metric "Dropped Samples" "$DROPPED_SAMPLES" "neutral" ""
+
+# Top offenders from the limiter's debug page
+CL_REPORT=$(curl -s "${CL_DEBUG_URL}?format=json&limit=3" 2>/dev/null || echo "")
+if [ -n "$CL_REPORT" ]; then
+  while IFS=$'\t' read -r name series dropped; do
+    print_metric "Top Metric ${name}" "$series" "neutral" "series (${dropped} dropped)"
+  done < <(echo "$CL_REPORT" | jq -r '.top_metrics[] | [.name, .series, .dropped] | @tsv' 2>/dev/null)
+  while IFS=$'\t' read -r name values; do
+    print_metric "Top Label ${name}" "$values" "neutral" "distinct values"
+  done < <(echo "$CL_REPORT" | jq -r '.top_labels[] | [.name, .distinct_values] | @tsv' 2>/dev/null)
+fi
 echo
 
 # Mock upstream status